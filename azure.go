@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureSecretSource reads the password from a secret of Azure Key Vault, like https://myvault.vault.azure.net/secrets/pgbouncer,
+// authenticated with the managed identity of the VM, container or App Service running the exporter
+type azureSecretSource struct {
+	client *http.Client
+	secret string
+
+	token        string
+	tokenExpires time.Time
+}
+
+func (a *azureSecretSource) fetch(ctx context.Context) (credentials, time.Duration, error) {
+	token, err := a.accessToken(ctx)
+	if err != nil {
+		return credentials{}, 0, err
+	}
+	var secret struct {
+		Value string `json:"value"`
+	}
+	if err := getJSON(ctx, a.client, strings.TrimSuffix(a.secret, "/")+"?api-version=7.4",
+		map[string]string{"Authorization": "Bearer " + token}, &secret); err != nil {
+		return credentials{}, 0, err
+	}
+	return credentials{password: secret.Value}, 0, nil
+}
+
+// accessToken returns an access token of the managed identity for Key Vault, cached until it is about to expire
+func (a *azureSecretSource) accessToken(ctx context.Context) (string, error) {
+	if a.token != "" && time.Now().Before(a.tokenExpires) {
+		return a.token, nil
+	}
+
+	query := url.Values{}
+	query.Set("resource", "https://vault.azure.net")
+	// A user assigned identity is chosen with its client ID
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	var (
+		endpoint string
+		headers  map[string]string
+	)
+	if identityEndpoint := os.Getenv("IDENTITY_ENDPOINT"); identityEndpoint != "" {
+		// App Service and Container Apps
+		query.Set("api-version", "2019-08-01")
+		endpoint = identityEndpoint
+		headers = map[string]string{"X-IDENTITY-HEADER": os.Getenv("IDENTITY_HEADER")}
+	} else {
+		// Instance metadata service of VMs and AKS nodes
+		query.Set("api-version", "2018-02-01")
+		endpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+		headers = map[string]string{"Metadata": "true"}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	if err := getJSON(ctx, a.client, endpoint+"?"+query.Encode(), headers, &token); err != nil {
+		return "", fmt.Errorf("cannot get an access token of the managed identity: %s", err)
+	}
+	expiresIn, err := strconv.Atoi(token.ExpiresIn)
+	if err != nil {
+		expiresIn = 300
+	}
+	a.token = token.AccessToken
+	a.tokenExpires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return a.token, nil
+}
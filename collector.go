@@ -17,38 +17,39 @@ limitations under the License.
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/lib/pq"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
 )
 
-//NewExporter creates a new exporter in a namespace for a given connection string of a pgbouncer server. namespace is always pgbouncer
-func NewExporter(connectionString string, namespace string) *Exporter {
-
-	db, err := getDB(connectionString)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return &Exporter{
-		metricMap:        makeMetricMaps(namespace),
-		namespace:        namespace,
-		db:               db,
-		connectionString: connectionString,
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Name:      "up",
-			Help:      "Was the PgBouncer instance query successful?",
-		}),
+var invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_]")
 
+//NewExporter creates a new exporter in a namespace for a given connection string of a pgbouncer server. namespace is always pgbouncer
+// When several targets are given, every pgbouncer is scraped and its series are labeled with its target name.
+// It returns an error when the connection string of a target is invalid.
+func NewExporter(targets []TargetConfig, namespace string, opts ...ExporterOpt) (*Exporter, error) {
+	e := &Exporter{
+		namespace:         namespace,
+		collectNamespaces: make(map[string]bool),
+		showCommands:      make(map[string]string),
+		groupLimits:       make(map[string]int),
+		excludedRows:      make(map[string]rowFilter),
+		histogramBuckets:  make(map[string][]float64),
 		duration: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "last_scrape_duration_seconds",
@@ -66,17 +67,649 @@ func NewExporter(connectionString string, namespace string) *Exporter {
 			Name:      "last_scrape_error",
 			Help:      "Whether the last scrape of metrics from PgBouncer resulted in an error (1 for error, 0 for success).",
 		}),
+		targetLabel:      "target",
+		queryConcurrency: 1,
+	}
+	for namespace, enabled := range defaultCollectNamespaces {
+		e.collectNamespaces[namespace] = enabled
+	}
+	for namespace, command := range defaultShowCommands {
+		e.showCommands[namespace] = command
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	e.targetTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "target_scrape_timeouts_total",
+		Help:      "Total number of scrapes of a PgBouncer target that timed out.",
+	}, []string{e.targetLabel})
+	e.reconnectAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "target_reconnect_attempts_total",
+		Help:      "Total number of attempts to connect again to a PgBouncer target which failed.",
+	}, []string{e.targetLabel})
+	e.reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "target_reconnects_total",
+		Help:      "Total number of successful connections to a PgBouncer target which failed.",
+	}, []string{e.targetLabel})
+	e.cardinalityLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "label_cardinality_limited_total",
+		Help:      "Total number of label sets summed into the overflow series of a namespace, beyond collector.cardinality-limit.",
+	}, []string{"namespace"})
+	e.parseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "scrape_parse_errors_total",
+		Help:      "Total number of values of a namespace which could not be parsed, skipped from the scrape.",
+	}, []string{"namespace"})
+	e.namespaceErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "namespace_scrape_errors_total",
+		Help:      "Total number of scrapes of a namespace whose SHOW command failed, or whose rows could not all be parsed.",
+	}, []string{"namespace"})
+	e.watchdogKills = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "watchdog_kills_total",
+		Help:      "Total number of connections to a PgBouncer target closed as it did not answer a query within pgBouncer.watchdogDeadline.",
+	}, []string{e.targetLabel})
+	e.unmappedColumns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "unmapped_columns_total",
+		Help:      "Total number of scrapes of a namespace returning a column without a mapping, or missing a mapped column, like with another version of PgBouncer.",
+	}, []string{"namespace", "column"})
+	for _, metric := range dbStatsMetrics {
+		e.dbStatsDescs = append(e.dbStatsDescs, prometheus.NewDesc(fmt.Sprintf("%s_exporter_db_%s", namespace, metric.name), metric.help, []string{e.targetLabel}, nil))
+	}
+	e.queryRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace + "_exporter",
+		Name:      "query_retries_total",
+		Help:      "Total number of SHOW commands of a namespace run again within a scrape after a transient error.",
+	}, []string{"namespace"})
+
+	if err := e.SetTargets(targets); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetTargets replaces the pgbouncers scraped by the exporter.
+// The connections to the targets kept are reused, and the others are closed.
+// When the connection string of a target is invalid, the current targets are kept and the error is returned.
+func (e *Exporter) SetTargets(targets []TargetConfig) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	configs := targets
+	if e.credentials != nil {
+		// The targets whose credentials changed get new connections, as their key changes
+		user, password := e.credentials()
+		targets = withCredentials(targets, user, password)
+	}
+
+	// Series of the same name must have the same labels, so every target gets the labels of all targets
+	labelNames := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, config := range targets {
+		for name := range config.Labels {
+			labelNames[name] = true
+		}
+		names[config.Name] = true
+	}
+	previous := make(map[string]*target)
+	for _, t := range e.targets {
+		previous[t.key] = t
+	}
+
+	// The new targets are opened first, so that nothing changes when one of them is invalid
+	opened := make([]*target, len(targets))
+	reused := make(map[string]bool)
+	for i, config := range targets {
+		if _, ok := previous[config.key()]; ok && !reused[config.key()] {
+			reused[config.key()] = true
+			continue
+		}
+		t, err := e.openTarget(config)
+		if err != nil {
+			for _, t := range opened {
+				if t != nil {
+					t.close()
+				}
+			}
+			name := config.Name
+			if name == "" {
+				name = targetName(config.DSN, i, names)
+			}
+			return fmt.Errorf("invalid connection string of target %s: %s", name, err)
+		}
+		opened[i] = t
+	}
+
+	e.targetConfigs = configs
+	e.targets = nil
+	for i, config := range targets {
+		t, ok := previous[config.key()]
+		if ok {
+			delete(previous, config.key())
+			t.resetVersion()
+			// The cached metrics have the former labels and metric maps
+			t.setCache(nil, time.Time{})
+		} else {
+			t = opened[i]
+		}
+		t.name = config.Name
+		t.timeout = config.Timeout
+		if t.timeout == 0 {
+			t.timeout = e.scrapeTimeout
+		}
+		if t.name == "" {
+			t.name = targetName(config.DSN, i, names)
+		}
+		if t.watchdog != nil {
+			t.watchdog.setTarget(t.name, e.watchdogKills.WithLabelValues(t.name))
+		}
+		constLabels := prometheus.Labels{}
+		for name := range labelNames {
+			constLabels[name] = config.Labels[name]
+		}
+		if len(targets) > 1 {
+			constLabels[e.targetLabel] = t.name
+		}
+		t.metricMap = e.makeMetricMaps(constLabels, config.Collectors)
+		e.setTargetDescs(t, constLabels)
+		t.group = config.Group
+		e.targets = append(e.targets, t)
+	}
+
+	// The sum of the peers of a group is labeled like a target named after the group
+	e.groups = nil
+	groups := make(map[string]*peerGroup)
+	for i, t := range e.targets {
+		if t.group == "" || e.peerAggregation == "" || e.peerAggregation == "none" {
+			continue
+		}
+		g, ok := groups[t.group]
+		if !ok {
+			g = &peerGroup{target: &target{name: t.group, timeout: t.timeout}}
+			constLabels := prometheus.Labels{}
+			for name := range labelNames {
+				constLabels[name] = ""
+			}
+			if len(targets) > 1 {
+				constLabels[e.targetLabel] = t.group
+			}
+			g.metricMap = e.makeMetricMaps(constLabels, targets[i].Collectors)
+			e.setTargetDescs(g.target, constLabels)
+			groups[t.group] = g
+			e.groups = append(e.groups, g)
+		}
+		g.members = append(g.members, t)
+	}
+	for _, t := range previous {
+		t.close()
+	}
+	return nil
+}
+
+// setTargetDescs sets the descriptions of the metrics of a target not coming from pgbouncer
+func (e *Exporter) setTargetDescs(t *target, constLabels prometheus.Labels) {
+	t.upDesc = prometheus.NewDesc(fmt.Sprintf("%s_up", e.namespace), "Was the PgBouncer instance query successful?", nil, constLabels)
+	t.staleDesc = prometheus.NewDesc(fmt.Sprintf("%s_metrics_stale", e.namespace), "Whether the metrics served are those of the last successful scrape, as PgBouncer is down.", nil, constLabels)
+	t.staleAgeDesc = prometheus.NewDesc(fmt.Sprintf("%s_metrics_stale_seconds", e.namespace), "Age of the metrics served, when they are those of the last successful scrape.", nil, constLabels)
+	if e.consistentSnapshot {
+		t.snapshotDesc = prometheus.NewDesc(fmt.Sprintf("%s_snapshot_span_seconds", e.namespace), "Time between the first and the last SHOW command of the scrape, run one after the other on a single connection.", nil, constLabels)
+	}
+}
+
+// openTarget returns a new target connecting to the connection strings of config
+func (e *Exporter) openTarget(config TargetConfig) (*target, error) {
+	t := &target{connectionString: config.DSN, key: config.key()}
+	if e.watchdogDeadline > 0 {
+		t.watchdog = &watchdogDialer{deadline: e.watchdogDeadline}
+	}
+	db, err := getDB(e.connectionString(config.DSN), t.watchdog)
+	if err != nil {
+		return nil, err
+	}
+	t.db = db
+	for _, fallback := range config.Fallbacks {
+		db, err := getDB(e.connectionString(fallback), t.watchdog)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.fallbacks = append(t.fallbacks, db)
+	}
+	for _, db := range append([]*sql.DB{t.db}, t.fallbacks...) {
+		db.SetMaxOpenConns(e.queryConcurrency)
+		db.SetMaxIdleConns(e.queryConcurrency)
+	}
+	return t, nil
+}
+
+// makeMetricMaps returns the metric maps of the enabled namespaces, configured by the exporter options.
+// collectors enables or disables namespaces for this target only.
+func (e *Exporter) makeMetricMaps(constLabels prometheus.Labels, collectors map[string]bool) []*MetricMapFromNamespace {
+	namespace := e.namespace
+	extraLabels := make(map[string][]string)
+	if e.configDefaults {
+		extraLabels["config"] = []string{"changeable"}
+	}
+	if e.cardinalityLimit > 0 {
+		for name := range metricRowMaps {
+			extraLabels[name] = append(extraLabels[name], "overflow")
+		}
+		for name := range e.customQueries {
+			extraLabels[name] = append(extraLabels[name], "overflow")
+		}
+	}
+	overrides := make(map[string]map[string]ColumnMapping, len(e.metricMappings))
+	for name, mappings := range e.metricMappings {
+		overrides[name] = mappings
+	}
+	if e.poolsByDatabase {
+		// The user column is dropped, and the rows of the remaining labels summed
+		overrides["pools"] = withMappingOverrides(overrides["pools"], discardedColumns("user"))
+	}
+	if e.dropBackendLabels {
+		overrides["databases"] = withMappingOverrides(overrides["databases"], discardedColumns("host", "port", "force_user"))
+	}
+	var metricMap []*MetricMapFromNamespace
+	for _, mapping := range makeMetricMaps(namespace, extraLabels, constLabels, overrides, e.customQueries) {
+		enabled, ok := collectors[mapping.namespace]
+		if !ok {
+			enabled, ok = e.collectNamespaces[mapping.namespace]
+		}
+		if ok && !enabled {
+			log.Debugln("Namespace is disabled:", mapping.namespace)
+			continue
+		}
+		if command, ok := e.showCommands[mapping.namespace]; ok {
+			mapping.command = command
+		}
+		mapping.excludedRows = e.excludedRows[mapping.namespace]
+		mapping.lowercaseLabels = e.lowercaseLabels
+		mapping.hashedLabels = e.hashedLabels
+		if e.poolsByDatabase && mapping.namespace == "pools" {
+			mapping.mergeKeys = mapping.labels
+		}
+		if _, row := metricRowMaps[mapping.namespace]; e.cardinalityLimit > 0 && (row || mapping.query != "") {
+			mapping.cardinalityLimit = e.cardinalityLimit
+			mapping.cardinalityLimited = e.cardinalityLimited.WithLabelValues(mapping.namespace)
+		}
+		if _, kv := metricKVMaps[mapping.namespace]; !kv {
+			mapping.unmappedColumns = e.unmappedColumns
+		}
+		if e.retries > 0 {
+			mapping.retries = e.retries
+			mapping.retryDelay = e.retryDelay
+			mapping.retried = e.queryRetries.WithLabelValues(mapping.namespace)
+		}
+		if limit, ok := e.groupLimits[mapping.namespace]; ok {
+			mapping.groupLimit = limit
+		}
+		for name, metricMapping := range mapping.columnMappings {
+			if metricMapping.usage != HISTOGRAM {
+				continue
+			}
+			if buckets, ok := e.histogramBuckets[mapping.namespace]; ok {
+				metricMapping.buckets = buckets
+			}
+			metricMapping.nativeBucketFactor = e.nativeBucketFactor
+			mapping.columnMappings[name] = metricMapping
+		}
+		if e.exportUnknownColumns {
+			mapping.unknownPrefix = fmt.Sprintf("%s_%s", namespace, mapping.namespace)
+			if mapping.query != "" {
+				mapping.unknownPrefix = mapping.namespace
+			}
+		}
+		if mapping.namespace == "config" && e.configSettingsInfo {
+			mapping.infoDesc = prometheus.NewDesc(fmt.Sprintf("%s_config_setting_info", namespace),
+				"SHOW CONFIG setting without a numeric metric, with its current value. Always 1", []string{"name", "value"}, constLabels)
+		}
+		if mapping.namespace == "config" && e.configDefaults {
+			mapping.defaultDesc = prometheus.NewDesc(fmt.Sprintf("%s_config_non_default", namespace),
+				"Whether the SHOW CONFIG setting differs from its default value (1 if it differs, 0 otherwise)", []string{"name"}, constLabels)
+		}
+		if mapping.namespace == "lists" {
+			// Every client and server connection holds a socket; SHOW FDS would list them, but blocks pgbouncer
+			mapping.sumDesc = prometheus.NewDesc(fmt.Sprintf("%s_lists_used_fds", namespace),
+				"File descriptors used by the client and server connections, used_clients + used_servers, without the listening sockets", nil, constLabels)
+			mapping.summedKeys = map[string]bool{"used_clients": true, "used_servers": true}
+			mapping.doneFunc = metricKVSumFinisher
+		}
+		metricMap = append(metricMap, mapping)
+	}
+	return metricMap
+}
+
+// ExporterOpt configures an Exporter
+type ExporterOpt func(*Exporter)
+
+// CollectNamespace enables or disables scraping of the given namespace
+func CollectNamespace(namespace string, enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.collectNamespaces[namespace] = enabled
+	}
+}
+
+// ConfigSettingsInfo exports the SHOW CONFIG settings without a numeric metric as info metrics
+func ConfigSettingsInfo(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.configSettingsInfo = enabled
+	}
+}
+
+// ConfigDefaults labels the SHOW CONFIG metrics as changeable or not, and exports whether each setting differs
+// from its default value. Requires pgbouncer 1.18 or later.
+func ConfigDefaults(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.configDefaults = enabled
+	}
+}
+
+// PoolsByDatabase sums the rows of SHOW POOLS by database, dropping the user label
+func PoolsByDatabase(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.poolsByDatabase = enabled
+	}
+}
+
+// DropDatabaseBackendLabels drops the host, port and force_user labels of the databases namespace,
+// which churn when the backend hosts rotate
+func DropDatabaseBackendLabels(drop bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.dropBackendLabels = drop
+	}
+}
+
+// ExportUnknownColumns exports the numeric columns missing from the static maps as untyped metrics,
+// instead of ignoring them
+func ExportUnknownColumns(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.exportUnknownColumns = enabled
+	}
+}
+
+// GroupLimit limits the number of label sets exported by an aggregated namespace. The smallest groups beyond
+// the limit are merged into a single group labeled "other". 0 disables the limit.
+func GroupLimit(namespace string, limit int) ExporterOpt {
+	return func(e *Exporter) {
+		e.groupLimits[namespace] = limit
+	}
+}
+
+// LowercaseLabelValues lowercases the values of the labels taken from the rows of pgbouncer
+func LowercaseLabelValues(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.lowercaseLabels = enabled
+	}
+}
+
+// HashLabelValues replaces the values of the given labels, like database names which are sensitive,
+// with the first 16 hexadecimal digits of their SHA-256 hash
+func HashLabelValues(labels []string) ExporterOpt {
+	return func(e *Exporter) {
+		e.hashedLabels = make(map[string]bool, len(labels))
+		for _, label := range labels {
+			e.hashedLabels[label] = true
+		}
+	}
+}
+
+// ExcludeRows skips the rows of a namespace having one of the given values in a column
+func ExcludeRows(namespace string, column string, values []string) ExporterOpt {
+	return func(e *Exporter) {
+		if len(values) == 0 {
+			return
+		}
+		if e.excludedRows[namespace] == nil {
+			e.excludedRows[namespace] = make(rowFilter)
+		}
+		if e.excludedRows[namespace][column] == nil {
+			e.excludedRows[namespace][column] = make(map[string]bool)
+		}
+		for _, value := range values {
+			e.excludedRows[namespace][column][value] = true
+		}
+	}
+}
+
+// CardinalityLimit limits the number of label sets exported by each namespace of SHOW rows and custom query.
+// The rows of the label sets beyond the limit are summed into a single series labeled overflow="true".
+// 0 disables the limit.
+func CardinalityLimit(limit int) ExporterOpt {
+	return func(e *Exporter) {
+		e.cardinalityLimit = limit
+	}
+}
+
+// HistogramBuckets sets the buckets of the histograms of an aggregated namespace
+func HistogramBuckets(namespace string, buckets []float64) ExporterOpt {
+	return func(e *Exporter) {
+		e.histogramBuckets[namespace] = buckets
+	}
+}
+
+// NativeHistogramBucketFactor also exports the histograms of the aggregated namespaces as native histograms,
+// with buckets growing by factor. 0 only exports their classic buckets.
+func NativeHistogramBucketFactor(factor float64) ExporterOpt {
+	return func(e *Exporter) {
+		e.nativeBucketFactor = factor
+	}
+}
+
+// ScrapeTimeout sets the timeout of the scrape of the targets without their own
+func ScrapeTimeout(timeout time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.scrapeTimeout = timeout
+	}
+}
+
+// MinScrapeInterval serves the metrics of the last scrape of the targets to the scrapes coming less than interval
+// after it began, like those of a pair of Prometheus servers, rather than querying pgbouncer again. 0 disables it.
+func MinScrapeInterval(interval time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.minInterval = interval
+	}
+}
+
+// ServeStale serves the metrics of the last successful scrape of a target which is down for up to maxAge,
+// flagged by pgbouncer_metrics_stale. 0 disables it.
+func ServeStale(maxAge time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.serveStale = maxAge
+	}
+}
+
+// ConnectTimeout sets the timeout of the connections to the targets and of each of their SHOW queries
+func ConnectTimeout(timeout time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.connectTimeout = timeout
+	}
+}
+
+// ReconnectBackoff delays the connections to a target which failed, from initial doubled on every failure up to max,
+// with jitter, rather than connecting again on every scrape. An initial delay of 0 disables the backoff.
+func ReconnectBackoff(initial, max time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.reconnectBackoff = initial
+		e.reconnectBackoffMax = max
+	}
+}
+
+// SSL sets the sslmode, root certificates, client certificate and key of the connections to the targets,
+// unless set by their connection strings. Empty values are left to the connection strings and libpq defaults.
+func SSL(mode string, rootCert string, cert string, key string) ExporterOpt {
+	return func(e *Exporter) {
+		e.sslParameters = nil
+		for _, param := range [][2]string{{"sslmode", mode}, {"sslrootcert", rootCert}, {"sslcert", cert}, {"sslkey", key}} {
+			if param[1] != "" {
+				e.sslParameters = append(e.sslParameters, param)
+			}
+		}
+	}
+}
+
+// ScrapeConcurrency limits the number of targets scraped at once, 0 for no limit
+func ScrapeConcurrency(concurrency int) ExporterOpt {
+	return func(e *Exporter) {
+		e.scrapeConcurrency = concurrency
+	}
+}
+
+// QueryRetries runs the SHOW commands failing with a transient error, like a connection reset, again up to
+// retries times within the scrape, after delay
+func QueryRetries(retries int, delay time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.retries = retries
+		e.retryDelay = delay
+	}
+}
+
+// QueryWatchdog closes the connections to the targets whose queries are not answered within deadline, 0 to disable it
+func QueryWatchdog(deadline time.Duration) ExporterOpt {
+	return func(e *Exporter) {
+		e.watchdogDeadline = deadline
+	}
+}
+
+// ConsistentSnapshot runs the SHOW commands of a target one after the other on a single connection, so that
+// its metrics are as close as possible to a snapshot of pgbouncer. It overrides QueryConcurrency.
+func ConsistentSnapshot(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.consistentSnapshot = enabled
+	}
+}
+
+// QueryConcurrency sets the number of connections to each target over which its namespaces are queried at once
+func QueryConcurrency(concurrency int) ExporterOpt {
+	return func(e *Exporter) {
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		e.queryConcurrency = concurrency
+	}
+}
+
+// CloseConnections closes the connections to the targets after every scrape, rather than keeping them open
+// in between, so that the exporter does not hold an admin console connection of pgbouncer all the time
+func CloseConnections(enabled bool) ExporterOpt {
+	return func(e *Exporter) {
+		e.closeConnections = enabled
+	}
+}
+
+// TargetLabel sets the name of the label identifying the target of every series, when there are several targets
+func TargetLabel(name string) ExporterOpt {
+	return func(e *Exporter) {
+		e.targetLabel = name
+	}
+}
+
+// PeerAggregation exports the sum of the peers of each group of targets sharing a port with so_reuseport.
+// mode is "none", "sum" to only export the sum, or "both" to also export every peer.
+func PeerAggregation(mode string) ExporterOpt {
+	return func(e *Exporter) {
+		e.peerAggregation = mode
+	}
+}
+
+// OnTargetDown calls f, in its own goroutine, whenever a target does not answer
+func OnTargetDown(f func()) ExporterOpt {
+	return func(e *Exporter) {
+		e.onTargetDown = f
+	}
+}
+
+// Credentials sets the user and password returned by f in the connection strings of the targets
+func Credentials(f func() (user string, password string)) ExporterOpt {
+	return func(e *Exporter) {
+		e.credentials = f
+	}
+}
+
+// ReloadCredentials reconnects to the targets with the current credentials
+func (e *Exporter) ReloadCredentials() error {
+	e.mutex.RLock()
+	targets := e.targetConfigs
+	e.mutex.RUnlock()
+	return e.SetTargets(targets)
+}
+
+// Reconnect closes the connections to the targets and opens new ones, like to use rotated client certificates
+func (e *Exporter) Reconnect() error {
+	e.mutex.Lock()
+	for _, t := range e.targets {
+		t.close()
+	}
+	// The groups hold the closed targets too, until SetTargets builds them again from the new ones
+	e.targets = nil
+	e.groups = nil
+	targets := e.targetConfigs
+	e.mutex.Unlock()
+	return e.SetTargets(targets)
+}
+
+// connectionString returns the connection string of a target with the connection parameters of the exporter.
+// They override those of its connection service, so it is resolved first.
+func (e *Exporter) connectionString(dsn string) string {
+	if resolved, err := resolveService(dsn); err == nil {
+		dsn = resolved
+	}
+	return withDefaultParameters(withConnectTimeout(dsn, e.connectTimeout), e.sslParameters)
+}
+
+// MetricMappings overrides the column mappings of the SHOW commands, by namespace, from a mapping file.
+// They apply to the metric maps built by the next SetTargets.
+func MetricMappings(mappings map[string]map[string]ColumnMapping) ExporterOpt {
+	return func(e *Exporter) {
+		e.metricMappings = mappings
+	}
+}
+
+// SetMetricMappings replaces the overrides of the column mappings, applied by the next SetTargets
+func (e *Exporter) SetMetricMappings(mappings map[string]map[string]ColumnMapping) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.metricMappings = mappings
+}
+
+// CustomQueries adds the namespaces of the queries of a custom queries file, by namespace.
+// They apply to the metric maps built by the next SetTargets.
+func CustomQueries(queries map[string]CustomQuery) ExporterOpt {
+	return func(e *Exporter) {
+		e.customQueries = queries
+	}
+}
+
+// SetCustomQueries replaces the custom queries, applied by the next SetTargets
+func (e *Exporter) SetCustomQueries(queries map[string]CustomQuery) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.customQueries = queries
+}
+
+// ShowCommand scrapes the given namespace with another SHOW command returning the same columns
+func ShowCommand(namespace string, command string) ExporterOpt {
+	return func(e *Exporter) {
+		e.showCommands[namespace] = command
 	}
 }
 
 // Query within a namespace mapping and emit metrics. Returns fatal errors if
-func getDB(conn string) (*sql.DB, error) {
+func getDB(conn string, watchdog *watchdogDialer) (*sql.DB, error) {
 	// Note we use OpenDB so we can still create the connector even if the backend is down.
-	connector, err := pq.NewConnector(conn)
+	config, err := parseConfig(conn)
 	if err != nil {
 		return nil, err
 	}
-	db := sql.OpenDB(connector)
+	if watchdog != nil {
+		config.DialFunc = watchdog.dialFunc(config.DialFunc)
+	}
+	db := stdlib.OpenDB(*config)
 
 	db.SetMaxOpenConns(1)
 	db.SetMaxIdleConns(1)
@@ -84,77 +717,191 @@ func getDB(conn string) (*sql.DB, error) {
 	return db, nil
 }
 
+// parseConfig parses a connection string, resolving its connection service, into the configuration of pgx with the
+// simple query protocol, the only one supported by the admin console of pgbouncer. Without an sslmode, TLS is required
+// rather than preferred, which would fall back to unencrypted connections.
+func parseConfig(conn string) (*pgx.ConnConfig, error) {
+	conn, err := resolveService(conn)
+	if err != nil {
+		return nil, withoutConnectionString(err)
+	}
+	if _, ok := os.LookupEnv("PGSSLMODE"); !ok {
+		conn = withDefaultParameters(conn, [][2]string{{"sslmode", "require"}})
+	}
+	conn = withoutEmptyPassword(conn)
+	config, err := pgx.ParseConfig(conn)
+	if err != nil {
+		return nil, withoutConnectionString(err)
+	}
+	if _, ok := connectionParameter(conn, "password"); !ok && os.Getenv("PGPASSWORD") == "" && insecurePassFile(passFile(conn)) {
+		// The password comes from the password file, which pgx reads whatever its permissions, but libpq ignores
+		// when other users can read it
+		config.Password = ""
+	}
+	config.PreferSimpleProtocol = true
+	return config, nil
+}
+
 //makeMetricMaps returns a single array of maps containing metic maps for each metric from each group of metrics (ie kv,row)
-func makeMetricMaps(metricNamespace string) []*MetricMapFromNamespace {
+// extraLabels lists, by namespace, additional columns to use as labels. constLabels are added to every metric.
+// overrides replaces the column mappings of the row and KV namespaces, by namespace. queries adds the namespaces of custom queries.
+func makeMetricMaps(metricNamespace string, extraLabels map[string][]string, constLabels prometheus.Labels, overrides map[string]map[string]ColumnMapping, queries map[string]CustomQuery) []*MetricMapFromNamespace {
 	var metricMap []*MetricMapFromNamespace
 
-	convert := func(namespace string, mappings map[string]ColumnMapping, converter RowConverter) *MetricMapFromNamespace {
-		thisMap := make(map[string]MetricMap)
+	for namespace, mappings := range metricRowMaps {
+		prefix := fmt.Sprintf("%s_%s", metricNamespace, namespace)
+		metricMap = append(metricMap, makeColumnMetricMap(prefix, namespace, withMappingOverrides(mappings, overrides[namespace]), extraLabels[namespace], constLabels, metricRowConverter))
+	}
+	for namespace, mappings := range metricKVMaps {
+		prefix := fmt.Sprintf("%s_%s", metricNamespace, namespace)
+		metricMap = append(metricMap, makeColumnMetricMap(prefix, namespace, withMappingOverrides(mappings, overrides[namespace]), extraLabels[namespace], constLabels, metricKVConverter))
+	}
+	for namespace, mappings := range metricAggregateMaps {
+		metricMap = append(metricMap, makeAggregateMetricMap(metricNamespace, namespace, mappings, constLabels))
+	}
+	for _, mapping := range metricMap {
+		if converter, ok := namespaceRowConverters[mapping.namespace]; ok {
+			mapping.rowFunc = converter
+		}
+	}
+	// Custom queries are named after their namespace alone, like in postgres_exporter
+	for namespace, query := range queries {
+		mapping := makeColumnMetricMap(namespace, namespace, query.columnMappings(), extraLabels[namespace], constLabels, metricRowConverter)
+		mapping.query = query.Query
+		metricMap = append(metricMap, mapping)
+	}
+	return metricMap
+}
+
+// makeColumnMetricMap builds the metric map of a namespace whose columns, or keys for KV namespaces, are exported
+// by the converter as metrics named after prefix and the column. extraLabels are additional columns to use as labels.
+func makeColumnMetricMap(prefix string, namespace string, mappings map[string]ColumnMapping, extraLabels []string, constLabels prometheus.Labels, converter RowConverter) *MetricMapFromNamespace {
+	thisMap := make(map[string]MetricMap)
+	discarded := make(map[string]bool)
 
-		labels := []string{}
-		for columnName, columnMapping := range mappings {
-			if columnMapping.usage == LABEL {
-				labels = append(labels, columnName)
-			}
+	labels := []string{}
+	for columnName, columnMapping := range mappings {
+		if columnMapping.usage == LABEL {
+			labels = append(labels, columnName)
+		}
+	}
+	labels = append(labels, extraLabels...)
+	for columnName, columnMapping := range mappings {
+		// Determine how to convert the column based on its usage.
+		desc := prometheus.NewDesc(fmt.Sprintf("%s_%s", prefix, columnName), columnMapping.description, labels, constLabels)
+		if columnMapping.promMetricName != "" {
+			desc = prometheus.NewDesc(fmt.Sprintf("%s_%s", prefix, columnMapping.promMetricName), columnMapping.description, labels, constLabels)
 		}
-		for columnName, columnMapping := range mappings {
-			// Determine how to convert the column based on its usage.
-			desc := prometheus.NewDesc(fmt.Sprintf("%s_%s_%s", metricNamespace, namespace, columnName), columnMapping.description, labels, nil)
-			if columnMapping.promMetricName != "" {
-				desc = prometheus.NewDesc(fmt.Sprintf("%s_%s_%s", metricNamespace, namespace, columnMapping.promMetricName), columnMapping.description, labels, nil)
-			}
 
-			switch columnMapping.usage {
-			case COUNTER:
-				thisMap[columnName] = MetricMap{
-					vtype:      prometheus.CounterValue,
-					desc:       desc,
-					multiplier: 1,
-				}
-			case GAUGE:
-				thisMap[columnName] = MetricMap{
-					vtype:      prometheus.GaugeValue,
-					desc:       desc,
-					multiplier: 1,
-				}
-			case GAUGE_MS:
-				thisMap[columnName] = MetricMap{
-					vtype:      prometheus.GaugeValue,
-					desc:       desc,
-					multiplier: 1e-6,
-				}
+		switch columnMapping.usage {
+		case COUNTER:
+			thisMap[columnName] = MetricMap{
+				vtype:      prometheus.CounterValue,
+				desc:       desc,
+				multiplier: 1,
+			}
+		case GAUGE:
+			thisMap[columnName] = MetricMap{
+				vtype:      prometheus.GaugeValue,
+				desc:       desc,
+				multiplier: 1,
+			}
+		case GAUGE_MS:
+			thisMap[columnName] = MetricMap{
+				vtype:      prometheus.GaugeValue,
+				desc:       desc,
+				multiplier: 1e-6,
 			}
+		case LIST, BOOLEAN:
+			thisMap[columnName] = MetricMap{
+				vtype:      prometheus.GaugeValue,
+				desc:       desc,
+				multiplier: 1,
+				usage:      columnMapping.usage,
+			}
+		case DISCARD:
+			discarded[columnName] = true
 		}
-		return &MetricMapFromNamespace{namespace: namespace, columnMappings: thisMap, labels: labels, rowFunc: converter}
 	}
+	return &MetricMapFromNamespace{namespace: namespace, columnMappings: thisMap, labels: labels, constLabels: constLabels, rowFunc: converter, discarded: discarded}
+}
 
-	for namespace, mappings := range metricRowMaps {
-		metricMap = append(metricMap, convert(namespace, mappings, metricRowConverter))
+// makeAggregateMetricMap builds the metric map of a namespace whose rows are aggregated per label set before being emitted
+func makeAggregateMetricMap(metricNamespace string, namespace string, mappings map[string]AggregateMapping, constLabels prometheus.Labels) *MetricMapFromNamespace {
+	thisMap := make(map[string]MetricMap)
+
+	labels := []string{}
+	for name, mapping := range mappings {
+		if mapping.usage == LABEL {
+			labels = append(labels, name)
+		}
 	}
-	for namespace, mappings := range metricKVMaps {
-		metricMap = append(metricMap, convert(namespace, mappings, metricKVConverter))
+	for name, mapping := range mappings {
+		if mapping.usage == LABEL {
+			continue
+		}
+		thisMap[name] = MetricMap{
+			vtype:      prometheus.GaugeValue,
+			desc:       prometheus.NewDesc(fmt.Sprintf("%s_%s_%s", metricNamespace, namespace, name), mapping.description, labels, constLabels),
+			multiplier: 1,
+			usage:      mapping.usage,
+			column:     mapping.column,
+			buckets:    prometheus.DefBuckets,
+		}
+	}
+	return &MetricMapFromNamespace{
+		namespace:      namespace,
+		columnMappings: thisMap,
+		labels:         labels,
+		constLabels:    constLabels,
+		rowFunc:        metricAggregateConverter,
+		doneFunc:       metricAggregateFinisher,
 	}
-	return metricMap
 }
 
-func metricRowConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
-	var nonFatalErrors []error
+// rowLabelValues returns the values of the namespace labels for the current row
+func rowLabelValues(m *MetricMapFromNamespace, result *rowResult) []string {
 	labelValues := []string{}
-	// collect label data first.
 	for _, name := range m.labels {
-		val := result.ColumnData[result.ColumnIdx[name]]
+		idx, ok := result.ColumnIdx[name]
+		if !ok {
+			// Label columns missing from older pgbouncer versions
+			labelValues = append(labelValues, "")
+			continue
+		}
+		val := result.ColumnData[idx]
 		if val == nil {
 			labelValues = append(labelValues, "")
-		} else if v, ok := val.(string); ok {
-			labelValues = append(labelValues, v)
-		} else if v, ok := val.(int64); ok {
-			labelValues = append(labelValues, strconv.FormatInt(v, 10))
+		} else {
+			// pgx returns the columns as strings, bytes, integers, floats or booleans by their type
+			labelValues = append(labelValues, m.labelValue(name, dbToString(val)))
 		}
 	}
+	return labelValues
+}
+
+// labelValue normalizes the value of a label: surrounding whitespace is trimmed, invalid UTF-8 is replaced,
+// and the value is lowercased or hashed when configured
+func (m *MetricMapFromNamespace) labelValue(name string, value string) string {
+	value = strings.TrimSpace(strings.ToValidUTF8(value, "\uFFFD"))
+	if m.lowercaseLabels {
+		value = strings.ToLower(value)
+	}
+	if m.hashedLabels[name] && value != "" {
+		sum := sha256.Sum256([]byte(value))
+		value = hex.EncodeToString(sum[:8])
+	}
+	return value
+}
+
+func metricRowConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	var nonFatalErrors []error
+	// collect label data first.
+	labelValues := rowLabelValues(m, result)
 
 	for idx, columnName := range result.ColumnNames {
 		if metricMapping, ok := m.columnMappings[columnName]; ok {
-			value, ok := dbToFloat64(result.ColumnData[idx])
+			value, ok := metricMapping.convert(result.ColumnData[idx])
 			if !ok {
 				nonFatalErrors = append(nonFatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", m.namespace, columnName, result.ColumnData[idx])))
 				continue
@@ -162,6 +909,8 @@ func metricRowConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<-
 			log.Debugln("successfully parsed column:", m.namespace, columnName, result.ColumnData[idx])
 			// Generate the metric
 			ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value*metricMapping.multiplier, labelValues...)
+		} else if m.unknownPrefix != "" && !m.isLabel(columnName) && !m.discarded[columnName] {
+			m.exportUnknown(ch, columnName, result.ColumnData[idx], labelValues)
 		} else {
 			log.Debugln("Ignoring column for metric conversion:", m.namespace, columnName)
 		}
@@ -169,6 +918,53 @@ func metricRowConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<-
 	return nonFatalErrors, nil
 }
 
+// countUnmappedColumns counts the columns without a mapping, which are neither labels nor discarded, and the mapped
+// columns missing. The aggregated namespaces only use some of the columns, so only their missing columns are counted.
+func (m *MetricMapFromNamespace) countUnmappedColumns(columnIdx map[string]int) {
+	_, aggregated := metricAggregateMaps[m.namespace]
+	if !aggregated {
+		for columnName := range columnIdx {
+			if _, ok := m.columnMappings[columnName]; !ok && !m.isLabel(columnName) && !m.discarded[columnName] {
+				log.Debugln("Column without a mapping:", m.namespace, columnName)
+				m.unmappedColumns.WithLabelValues(m.namespace, columnName).Inc()
+			}
+		}
+	}
+	for name, metricMapping := range m.columnMappings {
+		columnName := name
+		if aggregated {
+			columnName = metricMapping.column
+		}
+		if _, ok := columnIdx[columnName]; !ok && columnName != "" {
+			log.Debugln("Mapped column missing:", m.namespace, columnName)
+			m.unmappedColumns.WithLabelValues(m.namespace, columnName).Inc()
+		}
+	}
+}
+
+func (m *MetricMapFromNamespace) isLabel(columnName string) bool {
+	for _, label := range m.labels {
+		if label == columnName {
+			return true
+		}
+	}
+	return false
+}
+
+// exportUnknown exports a column missing from the static maps as an untyped metric, when its value is numeric.
+// It returns false if the value could not be exported.
+func (m *MetricMapFromNamespace) exportUnknown(ch chan<- prometheus.Metric, columnName string, t interface{}, labelValues []string) bool {
+	value, ok := dbToFloat64(t)
+	if !ok {
+		log.Debugln("Ignoring non numeric unknown column:", m.namespace, columnName)
+		return false
+	}
+	name := fmt.Sprintf("%s_%s", m.unknownPrefix, invalidMetricChars.ReplaceAllString(strings.ToLower(columnName), "_"))
+	desc := prometheus.NewDesc(name, fmt.Sprintf("Unknown column %s of SHOW %s, exported as is", columnName, strings.ToUpper(m.namespace)), m.labels, m.constLabels)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value, labelValues...)
+	return true
+}
+
 func metricKVConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
 	// format is key, value, <ignorable> for row results.
 	if len(result.ColumnData) < 2 {
@@ -181,21 +977,359 @@ func metricKVConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- p
 	default:
 		return nil, errors.New(fmt.Sprintln("Received row results for KV parsing, but key field isn't string:", m.namespace, result.ColumnData))
 	}
+	labelValues := rowLabelValues(m, result)
+
+	if m.summedKeys[key] {
+		if value, ok := dbToFloat64(result.ColumnData[1]); ok {
+			result.Sum += value
+		}
+	}
+	if m.defaultDesc != nil {
+		if idx, ok := result.ColumnIdx["default"]; ok {
+			nonDefault := 0.0
+			if strings.TrimSpace(dbToString(result.ColumnData[1])) != strings.TrimSpace(dbToString(result.ColumnData[idx])) {
+				nonDefault = 1
+			}
+			ch <- prometheus.MustNewConstMetric(m.defaultDesc, prometheus.GaugeValue, nonDefault, key)
+		}
+	}
+
 	// is it a key we care about?
 	if metricMapping, ok := m.columnMappings[key]; ok {
-		value, ok := dbToFloat64(result.ColumnData[1])
+		value, ok := metricMapping.convertSetting(result.ColumnData[1])
 		if !ok {
 			return append([]error{}, errors.New(fmt.Sprintln("Unexpected error KV value: ", m.namespace, key, result.ColumnData[1]))), nil
 		}
 		log.Debugln("successfully parsed column:", m.namespace, key, result.ColumnData[1])
 		// Generate the metric
-		ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value*metricMapping.multiplier)
+		ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value*metricMapping.multiplier, labelValues...)
+	} else if m.discarded[key] {
+		log.Debugln("Ignoring discarded key:", m.namespace, key)
+	} else if m.unknownPrefix != "" && m.exportUnknown(ch, key, result.ColumnData[1], labelValues) {
+		log.Debugln("Exported unknown key:", m.namespace, key)
+	} else if m.infoDesc != nil {
+		// export keys without a numeric mapping as info metrics
+		ch <- prometheus.MustNewConstMetric(m.infoDesc, prometheus.GaugeValue, 1, m.labelValue("name", key), m.labelValue("value", dbToString(result.ColumnData[1])))
 	} else {
 		log.Debugln("Ignoring column for KV conversion:", m.namespace, key)
 	}
 	return nil, nil
 }
 
+func metricAggregateConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	var nonFatalErrors []error
+	labelValues := rowLabelValues(m, result)
+
+	if result.Groups == nil {
+		result.Groups = make(map[string]*aggregateGroup)
+	}
+	key := strings.Join(labelValues, "\xff")
+	group, ok := result.Groups[key]
+	if !ok {
+		group = &aggregateGroup{labelValues: labelValues, values: make(map[string]float64)}
+		result.Groups[key] = group
+	}
+
+	for name, metricMapping := range m.columnMappings {
+		if metricMapping.usage == COUNT {
+			group.values[name]++
+			continue
+		}
+		idx, ok := result.ColumnIdx[metricMapping.column]
+		if !ok {
+			log.Debugln("Ignoring missing column for aggregation:", m.namespace, metricMapping.column)
+			continue
+		}
+		value, ok := dbToFloat64(result.ColumnData[idx])
+		if !ok {
+			nonFatalErrors = append(nonFatalErrors, errors.New(fmt.Sprintln("Unexpected error parsing column: ", m.namespace, metricMapping.column, result.ColumnData[idx])))
+			continue
+		}
+		if metricMapping.usage == HISTOGRAM {
+			group.observe(name, value, metricMapping.buckets, metricMapping.nativeBucketFactor > 0)
+			continue
+		}
+		current, seen := group.values[name]
+		switch metricMapping.usage {
+		case SUM:
+			group.values[name] = current + value
+		case MAX:
+			if !seen || value > current {
+				group.values[name] = value
+			}
+		}
+	}
+	return nonFatalErrors, nil
+}
+
+// metricClientsWaitConverter only keeps waiting clients, and folds their wait_us column into wait
+func metricClientsWaitConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	if idx, ok := result.ColumnIdx["state"]; ok {
+		if !strings.HasPrefix(dbToString(result.ColumnData[idx]), "waiting") {
+			return nil, nil
+		}
+	}
+	if secondsIdx, ok := result.ColumnIdx["wait"]; ok {
+		if microsecondsIdx, ok := result.ColumnIdx["wait_us"]; ok {
+			seconds, ok := dbToFloat64(result.ColumnData[secondsIdx])
+			microseconds, usOk := dbToFloat64(result.ColumnData[microsecondsIdx])
+			if ok && usOk && !math.IsNaN(seconds) && !math.IsNaN(microseconds) {
+				result.ColumnData[secondsIdx] = seconds + microseconds*1e-6
+			}
+		}
+	}
+	return metricAggregateConverter(m, result, ch)
+}
+
+// metricPoolsConverter folds the maxwait_us column of newer pgbouncer versions into maxwait, for sub-second precision
+func metricPoolsConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	secondsIdx, ok := result.ColumnIdx["maxwait"]
+	if !ok {
+		return metricRowConverter(m, result, ch)
+	}
+	if microsecondsIdx, ok := result.ColumnIdx["maxwait_us"]; ok {
+		seconds, ok := dbToFloat64(result.ColumnData[secondsIdx])
+		microseconds, usOk := dbToFloat64(result.ColumnData[microsecondsIdx])
+		if ok && usOk && !math.IsNaN(seconds) && !math.IsNaN(microseconds) {
+			result.ColumnData[secondsIdx] = seconds + microseconds*1e-6
+		}
+	}
+	return metricRowConverter(m, result, ch)
+}
+
+// metricVersionConverter strips the "PgBouncer" prefix from SHOW VERSION rows before aggregating them
+func metricVersionConverter(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	if idx, ok := result.ColumnIdx["version"]; ok {
+		if v, ok := result.ColumnData[idx].(string); ok {
+			result.ColumnData[idx] = parseVersionString(v)
+		}
+	}
+	return metricAggregateConverter(m, result, ch)
+}
+
+// parseVersionString extracts the version number out of a SHOW VERSION value like "PgBouncer 1.21.0"
+func parseVersionString(v string) string {
+	for _, field := range strings.Fields(v) {
+		if field != "" && field[0] >= '0' && field[0] <= '9' {
+			return field
+		}
+	}
+	return strings.TrimSpace(v)
+}
+
+// metricKVSumFinisher exports the sum of the summed keys of a KV namespace
+func metricKVSumFinisher(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	ch <- prometheus.MustNewConstMetric(m.sumDesc, prometheus.GaugeValue, result.Sum)
+	return nil, nil
+}
+
+func metricAggregateFinisher(m *MetricMapFromNamespace, result *rowResult, ch chan<- prometheus.Metric) ([]error, error) {
+	groups := make([]*aggregateGroup, 0, len(result.Groups))
+	for _, group := range result.Groups {
+		groups = append(groups, group)
+	}
+	if m.groupLimit > 0 && len(groups) > m.groupLimit {
+		groups = limitAggregateGroups(m, groups)
+	}
+	for _, group := range groups {
+		for name, value := range group.values {
+			metricMapping := m.columnMappings[name]
+			ch <- prometheus.MustNewConstMetric(metricMapping.desc, metricMapping.vtype, value*metricMapping.multiplier, group.labelValues...)
+		}
+		for name, histogram := range group.histograms {
+			metricMapping := m.columnMappings[name]
+			metric := prometheus.MustNewConstHistogram(metricMapping.desc, histogram.count, histogram.sum, histogram.buckets, group.labelValues...)
+			if metricMapping.nativeBucketFactor > 0 {
+				metric = newNativeHistogram(metric, metricMapping, histogram.observations)
+			}
+			ch <- metric
+		}
+	}
+	return nil, nil
+}
+
+// nativeHistogram is a constant histogram also holding native buckets, which the constant histograms
+// of this client library cannot
+type nativeHistogram struct {
+	prometheus.Metric
+	native prometheus.Histogram
+}
+
+// newNativeHistogram returns the constant histogram with the native buckets of the observations
+func newNativeHistogram(metric prometheus.Metric, mapping MetricMap, observations []float64) prometheus.Metric {
+	// Only the buckets of the histogram are written, its name is left to the constant histogram
+	native := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:                        "native",
+		Help:                        "native",
+		Buckets:                     mapping.buckets,
+		NativeHistogramBucketFactor: mapping.nativeBucketFactor,
+	})
+	for _, value := range observations {
+		native.Observe(value)
+	}
+	return nativeHistogram{Metric: metric, native: native}
+}
+
+func (h nativeHistogram) Write(out *dto.Metric) error {
+	if err := h.Metric.Write(out); err != nil {
+		return err
+	}
+	var native dto.Metric
+	if err := h.native.Write(&native); err != nil {
+		return err
+	}
+	out.Histogram = native.Histogram
+	return nil
+}
+
+// observe adds a value to the named histogram of the group, keeping the value itself for the native buckets
+func (g *aggregateGroup) observe(name string, value float64, buckets []float64, keep bool) {
+	if g.histograms == nil {
+		g.histograms = make(map[string]*aggregateHistogram)
+	}
+	histogram, ok := g.histograms[name]
+	if !ok {
+		histogram = &aggregateHistogram{buckets: make(map[float64]uint64, len(buckets))}
+		for _, upperBound := range buckets {
+			histogram.buckets[upperBound] = 0
+		}
+		g.histograms[name] = histogram
+	}
+	histogram.count++
+	histogram.sum += value
+	if keep {
+		histogram.observations = append(histogram.observations, value)
+	}
+	for upperBound := range histogram.buckets {
+		if value <= upperBound {
+			histogram.buckets[upperBound]++
+		}
+	}
+}
+
+// filterRows drops the rows having an excluded value
+func (m *MetricMapFromNamespace) filterRows(columnNames []string, rows [][]interface{}) [][]interface{} {
+	var filtered [][]interface{}
+	for _, row := range rows {
+		excluded := false
+		for i, name := range columnNames {
+			if values, ok := m.excludedRows[name]; ok && values[dbToString(row[i])] {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			log.Debugln("Skipping excluded row:", m.namespace, row)
+			continue
+		}
+		filtered = append(filtered, row)
+	}
+	return filtered
+}
+
+// limitCardinality keeps the rows of the first m.cardinalityLimit label sets, and sums the rows of the others into
+// a single row labeled overflow="true", with empty values for the other labels
+func (m *MetricMapFromNamespace) limitCardinality(columnNames []string, rows [][]interface{}) ([]string, [][]interface{}) {
+	columnIdx := make(map[string]int, len(columnNames))
+	for i, name := range columnNames {
+		columnIdx[name] = i
+	}
+	var labelIdx []int
+	for _, label := range m.labels {
+		if i, ok := columnIdx[label]; ok {
+			labelIdx = append(labelIdx, i)
+		}
+	}
+
+	var (
+		kept, overflow [][]interface{}
+		labelSets      = make(map[string]bool)
+		limited        = make(map[string]bool)
+	)
+	for _, row := range rows {
+		var labelValues []string
+		for _, i := range labelIdx {
+			labelValues = append(labelValues, dbToString(row[i]))
+		}
+		key := strings.Join(labelValues, "\xff")
+		if labelSets[key] || len(labelSets) < m.cardinalityLimit {
+			labelSets[key] = true
+			kept = append(kept, row)
+			continue
+		}
+		limited[key] = true
+		overflow = append(overflow, row)
+	}
+	if len(overflow) == 0 {
+		return columnNames, rows
+	}
+	log.Debugf("Summing %d label sets of %s beyond the cardinality limit into the overflow series", len(limited), m.namespace)
+	if m.cardinalityLimited != nil {
+		m.cardinalityLimited.Add(float64(len(limited)))
+	}
+
+	// Without key columns, the overflowing rows are merged into one
+	merged := mergePeerRows(m.namespace, columnNames, nil, overflow)[0]
+	for _, i := range labelIdx {
+		merged[i] = nil
+	}
+	columnNames = append(append([]string{}, columnNames...), "overflow")
+	for i, row := range kept {
+		kept[i] = append(row, nil)
+	}
+	return columnNames, append(kept, append(merged, "true"))
+}
+
+// limitAggregateGroups keeps the m.groupLimit largest groups, and merges the others into a single group
+// whose label values are all "other"
+func limitAggregateGroups(m *MetricMapFromNamespace, groups []*aggregateGroup) []*aggregateGroup {
+	total := func(g *aggregateGroup) float64 {
+		var sum float64
+		for _, v := range g.values {
+			sum += v
+		}
+		return sum
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return total(groups[i]) > total(groups[j])
+	})
+
+	other := &aggregateGroup{labelValues: make([]string, len(m.labels)), values: make(map[string]float64)}
+	for i := range other.labelValues {
+		other.labelValues[i] = "other"
+	}
+	for _, group := range groups[m.groupLimit:] {
+		for name, histogram := range group.histograms {
+			if other.histograms == nil {
+				other.histograms = make(map[string]*aggregateHistogram)
+			}
+			merged, ok := other.histograms[name]
+			if !ok {
+				merged = &aggregateHistogram{buckets: make(map[float64]uint64, len(histogram.buckets))}
+				other.histograms[name] = merged
+			}
+			merged.count += histogram.count
+			merged.sum += histogram.sum
+			merged.observations = append(merged.observations, histogram.observations...)
+			for upperBound, count := range histogram.buckets {
+				merged.buckets[upperBound] += count
+			}
+		}
+		for name, value := range group.values {
+			current, seen := other.values[name]
+			switch m.columnMappings[name].usage {
+			case MAX:
+				if !seen || value > current {
+					other.values[name] = value
+				}
+			default:
+				other.values[name] = current + value
+			}
+		}
+	}
+	return append(groups[:m.groupLimit], other)
+}
+
 // Convert database.sql types to float64s for Prometheus consumption. Null types are mapped to NaN. string and []byte
 // types are mapped as NaN and !ok
 func dbToFloat64(t interface{}) (float64, bool) {
@@ -227,3 +1361,127 @@ func dbToFloat64(t interface{}) (float64, bool) {
 		return math.NaN(), false
 	}
 }
+
+// convert turns a column value into a float64 according to the usage of the mapping
+func (m MetricMap) convert(t interface{}) (float64, bool) {
+	switch m.usage {
+	case LIST:
+		return dbToListLength(t)
+	case BOOLEAN:
+		return dbToBool(t)
+	default:
+		return dbToFloat64(t)
+	}
+}
+
+// convertSetting turns the value of a key of a KV namespace into a float64, like convert, and also understands the
+// booleans, durations and sizes some pgbouncer builds return for settings
+func (m MetricMap) convertSetting(t interface{}) (float64, bool) {
+	if m.usage == LIST || m.usage == BOOLEAN {
+		return m.convert(t)
+	}
+	return dbToSetting(t)
+}
+
+// Units of the durations and sizes of settings, in seconds and bytes
+var settingUnits = map[string]float64{
+	"us": 1e-6, "ms": 1e-3, "s": 1, "sec": 1, "min": 60, "h": 3600, "d": 86400,
+	"B": 1, "kB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40,
+}
+
+var settingWithUnit = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+)\s*([a-zA-Z]+)$`)
+
+// Convert settings to float64: numbers, yes/no booleans to 1/0, durations with a unit like "1 min" to seconds,
+// and sizes with a unit like "4096 B" to bytes. Null types are mapped to NaN.
+func dbToSetting(t interface{}) (float64, bool) {
+	var s string
+	switch v := t.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return dbToFloat64(t)
+	}
+	s = strings.TrimSpace(s)
+	if value, err := strconv.ParseFloat(s, 64); err == nil {
+		return value, true
+	}
+	if value, ok := dbToBool(s); ok {
+		return value, true
+	}
+	if match := settingWithUnit.FindStringSubmatch(s); match != nil {
+		if multiplier, ok := settingUnits[match[2]]; ok {
+			value, err := strconv.ParseFloat(match[1], 64)
+			return value * multiplier, err == nil
+		}
+	}
+	return math.NaN(), false
+}
+
+// Convert yes/no columns to 1/0. Null types are mapped to NaN.
+func dbToBool(t interface{}) (float64, bool) {
+	var s string
+	switch v := t.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case nil:
+		return math.NaN(), true
+	default:
+		return dbToFloat64(t)
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "yes", "on", "true", "1":
+		return 1, true
+	case "no", "off", "false", "0":
+		return 0, true
+	}
+	return math.NaN(), false
+}
+
+// Convert database.sql types to strings for use as label values. Null types are mapped to the empty string.
+func dbToString(t interface{}) string {
+	switch v := t.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Count the items of a comma separated list column. Null and empty values are mapped to 0.
+func dbToListLength(t interface{}) (float64, bool) {
+	var list string
+	switch v := t.(type) {
+	case []byte:
+		list = string(v)
+	case string:
+		list = v
+	case nil:
+		return 0, true
+	default:
+		return math.NaN(), false
+	}
+	list = strings.TrimSpace(list)
+	if list == "" {
+		return 0, true
+	}
+	return float64(len(strings.Split(list, ","))), true
+}
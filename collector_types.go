@@ -19,6 +19,7 @@ package main
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -26,16 +27,40 @@ import (
 type columnUsage int
 
 const (
-	LABEL    columnUsage = iota // Use this column as a label
-	COUNTER  columnUsage = iota // Use this column as a counter
-	GAUGE    columnUsage = iota // Use this column as a gauge
-	GAUGE_MS columnUsage = iota // Use this column for gauges that are microsecond data
+	LABEL     columnUsage = iota // Use this column as a label
+	COUNTER   columnUsage = iota // Use this column as a counter
+	GAUGE     columnUsage = iota // Use this column as a gauge
+	GAUGE_MS  columnUsage = iota // Use this column for gauges that are microsecond data
+	LIST      columnUsage = iota // Use the number of comma separated items of this column as a gauge
+	BOOLEAN   columnUsage = iota // Use this yes/no column as a 0/1 gauge
+	COUNT     columnUsage = iota // Count the rows sharing the same labels
+	SUM       columnUsage = iota // Sum this column over the rows sharing the same labels
+	MAX       columnUsage = iota // Keep the largest value of this column over the rows sharing the same labels
+	HISTOGRAM columnUsage = iota // Observe this column in a histogram over the rows sharing the same labels
+	DISCARD   columnUsage = iota // Ignore this column, even when exporting unknown columns
 )
 
 type rowResult struct {
 	ColumnNames []string
 	ColumnIdx   map[string]int
 	ColumnData  []interface{}
+	Groups      map[string]*aggregateGroup // Aggregated values, keyed by joined label values
+	Sum         float64                    // Sum of the values of the summed keys, for KV namespaces
+}
+
+// Accumulates the aggregated metric values of all rows sharing a label set
+type aggregateGroup struct {
+	labelValues []string
+	values      map[string]float64
+	histograms  map[string]*aggregateHistogram
+}
+
+// Observations of a HISTOGRAM column, in the format of prometheus.MustNewConstHistogram
+type aggregateHistogram struct {
+	count        uint64
+	sum          float64
+	buckets      map[float64]uint64 // Cumulative counts, by upper bound
+	observations []float64          // Observed values, kept for the native buckets when enabled
 }
 
 type RowConverter func(*MetricMapFromNamespace, *rowResult, chan<- prometheus.Metric) ([]error, error)
@@ -43,17 +68,49 @@ type RowConverter func(*MetricMapFromNamespace, *rowResult, chan<- prometheus.Me
 // Groups metric maps under a shared set of labels
 type MetricMapFromNamespace struct {
 	namespace      string
+	command        string               // SHOW command to run, defaults to the namespace
+	query          string               // Query run instead of the SHOW command, for custom queries
 	columnMappings map[string]MetricMap // Column mappings in this namespace
 	labels         []string
+	constLabels    prometheus.Labels // Labels added to every metric, identifying the target
 	rowFunc        RowConverter
+	doneFunc       RowConverter     // Called once all rows were consumed, if set
+	infoDesc       *prometheus.Desc // Info metric for the unmapped keys of KV namespaces, if set
+	defaultDesc    *prometheus.Desc // Whether KV values differ from the default column, if set
+	sumDesc        *prometheus.Desc // Sum of the values of summedKeys, for KV namespaces, if set
+	summedKeys     map[string]bool  // Keys whose values are summed into sumDesc
+	unknownPrefix  string           // Name prefix of the metrics exported for unknown columns, empty to ignore them
+	groupLimit     int              // Maximum number of label sets of aggregated namespaces, 0 for no limit
+	discarded      map[string]bool  // Columns ignored, even when exporting unknown columns
+	mergeKeys      []string         // Columns by which the rows are summed before their conversion, if set
+	excludedRows   rowFilter        // Rows skipped
+
+	lowercaseLabels bool            // Lowercase the label values
+	hashedLabels    map[string]bool // Labels whose values are replaced by their hash
+
+	cardinalityLimit   int                // Maximum number of label sets of row namespaces, the others being summed into an overflow series, 0 for no limit
+	cardinalityLimited prometheus.Counter // Counts the label sets summed into the overflow series, if set
+
+	unmappedColumns *prometheus.CounterVec // Counts the columns without a mapping and the mapped columns missing, if set
+
+	retries    int                // Number of times the query is run again after a transient error
+	retryDelay time.Duration      // Delay before running the query again
+	retried    prometheus.Counter // Counts the queries run again, if set
 }
 
+// Values of the rows skipped, by column
+type rowFilter map[string]map[string]bool
+
 // Stores the prometheus metric description which a given column will be mapped
 // to by the collector
 type MetricMap struct {
-	vtype      prometheus.ValueType // Prometheus valuetype
-	desc       *prometheus.Desc     // Prometheus descriptor
-	multiplier float64              // This is a multiplier to apply pgbouncer values in converting to prometheus norms.
+	vtype              prometheus.ValueType // Prometheus valuetype
+	desc               *prometheus.Desc     // Prometheus descriptor
+	multiplier         float64              // This is a multiplier to apply pgbouncer values in converting to prometheus norms.
+	usage              columnUsage          // Aggregation applied, for aggregated namespaces
+	column             string               // Source column, for aggregated namespaces
+	buckets            []float64            // Histogram buckets, for HISTOGRAM aggregations
+	nativeBucketFactor float64              // Growth factor of the native buckets of HISTOGRAM aggregations, 0 for classic buckets only
 }
 
 type ColumnMapping struct {
@@ -62,19 +119,160 @@ type ColumnMapping struct {
 	description    string      `yaml:"description"`
 }
 
-// Exporter collects PgBouncer stats from the given server and exports
+// A query of a custom queries file, like the queries.yml of postgres_exporter, with the mappings of its columns
+type CustomQuery struct {
+	Query   string                     `yaml:"query"`
+	Metrics []map[string]ColumnMapping `yaml:"metrics"`
+}
+
+// Describes a gauge computed over all rows sharing the same labels, for SHOW
+// commands whose raw rows are too high cardinality to be exported as is.
+// Aggregate maps are keyed by metric name; LABEL entries are keyed by column.
+type AggregateMapping struct {
+	usage       columnUsage // LABEL, COUNT, SUM, MAX or HISTOGRAM
+	column      string      // Source column, unused for LABEL and COUNT
+	description string
+}
+
+// Exporter collects PgBouncer stats from the given servers and exports
 // them using the prometheus metrics package.
 type Exporter struct {
+	namespace string
+	mutex     sync.RWMutex
+
+	duration, error prometheus.Gauge
+	totalScrapes    prometheus.Counter
+
+	targets []*target
+	groups  []*peerGroup
+
+	collectNamespaces    map[string]bool                     // Namespaces explicitly enabled or disabled
+	showCommands         map[string]string                   // SHOW command overrides, by namespace
+	groupLimits          map[string]int                      // Label set limits of aggregated namespaces, by namespace
+	excludedRows         map[string]rowFilter                // Rows skipped, by namespace
+	cardinalityLimit     int                                 // Label set limit of each row namespace, 0 for no limit
+	lowercaseLabels      bool                                // Lowercase the label values taken from the rows
+	hashedLabels         map[string]bool                     // Labels whose values are replaced by their hash
+	histogramBuckets     map[string][]float64                // Histogram buckets of aggregated namespaces, by namespace
+	nativeBucketFactor   float64                             // Growth factor of the native buckets of the histograms, 0 to disable them
+	configSettingsInfo   bool                                // Export unmapped SHOW CONFIG settings as info metrics
+	configDefaults       bool                                // Export the changeable and default columns of SHOW CONFIG
+	poolsByDatabase      bool                                // Sum the rows of SHOW POOLS by database, dropping the user label
+	dropBackendLabels    bool                                // Drop the host, port and force_user labels of SHOW DATABASES
+	exportUnknownColumns bool                                // Export unknown numeric columns as untyped metrics
+	scrapeTimeout        time.Duration                       // Timeout of the scrape of targets without their own, 0 for none
+	serveStale           time.Duration                       // How long the last metrics of a target which is down are served, 0 for never
+	minInterval          time.Duration                       // Minimum interval between the scrapes of the targets, serving the last metrics in between
+	connectTimeout       time.Duration                       // Timeout of the connections to the targets and of each of their queries, 0 for none
+	reconnectBackoff     time.Duration                       // Initial delay before reconnecting to a failed target, 0 to reconnect on every scrape
+	reconnectBackoffMax  time.Duration                       // Maximum delay before reconnecting to a failed target
+	sslParameters        [][2]string                         // TLS parameters of the connections to the targets, unless set by their connection strings
+	metricMappings       map[string]map[string]ColumnMapping // Overrides of the column mappings, by namespace
+	customQueries        map[string]CustomQuery              // Queries of the custom queries file, by namespace
+	scrapeConcurrency    int                                 // Maximum number of targets scraped at once, 0 for no limit
+	queryConcurrency     int                                 // Number of connections to each target over which its namespaces are queried at once
+	closeConnections     bool                                // Whether to close the connections to the targets after every scrape
+	consistentSnapshot   bool                                // Whether to run the SHOW commands of a target one after the other on a single connection
+	retries              int                                 // Number of times a SHOW command failing with a transient error is run again within a scrape
+	retryDelay           time.Duration                       // Delay before running a SHOW command again
+	watchdogDeadline     time.Duration                       // Delay after which a query not answered gets its connection closed, 0 for none
+	targetLabel          string                              // Name of the label identifying the target, when there are several
+	peerAggregation      string                              // Whether to export the sum of the peers of a group: "none", "sum" or "both"
+	onTargetDown         func()                              // Called when a target does not answer, like to reload rotated credentials
+	credentials          func() (string, string)             // User and password set in the connection strings of the targets, from a secret store
+	targetConfigs        []TargetConfig                      // Configurations of the targets, without the credentials
+
+	scrapeCallMutex sync.Mutex
+	scrapeCall      *scrapeCall // Scrape of the targets running, shared by the concurrent scrapes
+
+	scrapeCacheMutex sync.Mutex
+	scrapeCache      []prometheus.Metric // Metrics of the last scrape of the targets, with minInterval
+	scrapedAt        time.Time           // Beginning of the last scrape of the targets, with minInterval
+
+	targetTimeouts     *prometheus.CounterVec
+	reconnectAttempts  *prometheus.CounterVec
+	reconnects         *prometheus.CounterVec
+	cardinalityLimited *prometheus.CounterVec
+	parseErrors        *prometheus.CounterVec
+	namespaceErrors    *prometheus.CounterVec
+	queryRetries       *prometheus.CounterVec
+	watchdogKills      *prometheus.CounterVec
+	unmappedColumns    *prometheus.CounterVec
+	dbStatsDescs       []*prometheus.Desc // Statistics of the connection pools to the targets, in the order of dbStatsMetrics
+}
+
+// TargetStatus is the result of the last scrape of a target
+type TargetStatus struct {
+	Name       string
+	Up         bool
+	LastScrape time.Time // Zero until the target is scraped
+	Duration   time.Duration
+	Error      string
+}
+
+// TargetCheck is the result of the check of a target by the check-config command
+type TargetCheck struct {
+	Name       string
+	Collectors []string // Namespaces scraped, restricted to those supported by pgbouncer once connected
+	Version    string   // Version of pgbouncer, once connected
+	Errors     []string
+}
+
+// A scrape of the targets, whose metrics are shared by the scrapes waiting for it
+type scrapeCall struct {
+	done    chan struct{} // Closed when the scrape is over
+	metrics []prometheus.Metric
+}
+
+// A pgbouncer instance scraped by the exporter
+type target struct {
+	name             string // Identifies the target in the target label, when there are several
 	connectionString string
-	namespace        string
-	mutex            sync.RWMutex
+	timeout          time.Duration // Timeout of a scrape, 0 for none
+	db               *sql.DB
+	fallbacks        []*sql.DB       // Other endpoints of the same pgbouncer, tried in order when db fails
+	key              string          // Connection strings of the target, to reuse its connections when reloading
+	group            string          // Logical pgbouncer of the target, when several processes share its port
+	watchdog         *watchdogDialer // Dialer of the connections to the target, with the watchdog
+
+	metricMap    []*MetricMapFromNamespace
+	upDesc       *prometheus.Desc
+	staleDesc    *prometheus.Desc // Whether the metrics served are those of an earlier scrape
+	staleAgeDesc *prometheus.Desc // Age of the metrics served
+	snapshotDesc *prometheus.Desc // Time taken by the SHOW commands, with a consistent snapshot
 
-	duration, up, error prometheus.Gauge
-	totalScrapes        prometheus.Counter
+	statusMutex sync.Mutex
+	status      TargetStatus
 
-	metricMap []*MetricMapFromNamespace
+	cacheMutex sync.Mutex
+	cached     []prometheus.Metric // Metrics of the last successful scrape, when serving stale metrics
+	cachedAt   time.Time           // Time of the last successful scrape
 
-	db *sql.DB
+	backoffMutex sync.Mutex
+	failures     int       // Consecutive failed connections, for the reconnection backoff
+	retryAt      time.Time // Time before which the target is not connected to again
+
+	versionMutex       sync.Mutex
+	version            *pgbouncerVersion         // Detected pgbouncer version, nil until connected
+	supportedMetricMap []*MetricMapFromNamespace // metricMap restricted to the detected version
+}
+
+// Namespaces scraped unless told otherwise. Namespaces not listed here are always scraped.
+var defaultCollectNamespaces = map[string]bool{
+	"sockets":                false,
+	"peers":                  false,
+	"peer_pools":             false,
+	"clients_by_application": false,
+	"clients_wait":           false,
+	"stats_totals":           false,
+	"stats_averages":         false,
+	"fds":                    false,
+}
+
+// SHOW commands of the namespaces not named after their command
+var defaultShowCommands = map[string]string{
+	"clients_by_application": "CLIENTS",
+	"clients_wait":           "CLIENTS",
 }
 
 var metricKVMaps = map[string]map[string]ColumnMapping{
@@ -122,9 +320,95 @@ var metricKVMaps = map[string]map[string]ColumnMapping{
 		"log_disconnections":        {GAUGE, "", "Whether connection disconnects are logged."},
 		"log_pooler_errors":         {GAUGE, "", "Whether pooler errors are logged or not"},
 		"application_name_add_host": {GAUGE, "", "Whether pgbouncer add the client host address and port to the application name setting set on connection start or not"},
+		// Settings added by newer pgbouncer versions; TLS settings like server_tls_sslmode are strings, see collector.config.settings-info.
+		"max_prepared_statements":     {GAUGE, "", "Maximum number of prepared statements tracked per server connection; 0 disables prepared statement support in transaction and statement pooling"},
+		"max_db_client_connections":   {GAUGE, "", "Maximum number of client connections allowed per database"},
+		"max_user_client_connections": {GAUGE, "", "Maximum number of client connections allowed per user"},
+		"transaction_timeout":         {GAUGE, "transaction_timeout_seconds", "Maximum time that a transaction can run for before its client is disconnected"},
+		"cancel_wait_timeout":         {GAUGE, "cancel_wait_timeout_seconds", "Maximum time that a cancel request can wait to be forwarded to a server"},
+		"query_wait_notify":           {GAUGE, "query_wait_notify_seconds", "Time after which clients waiting for a server are notified that they are queued"},
+		"tcp_user_timeout":            {GAUGE, "", "Configurable for TCP_USER_TIMEOUT, in milliseconds"},
+		"server_fast_close":           {GAUGE, "", "Boolean; if 1, server connections are closed at the end of the current transaction once they are marked for closing"},
+		"so_reuseport":                {GAUGE, "", "Boolean; if 1, the listening sockets are opened with SO_REUSEPORT, allowing several pgbouncer processes to share a port"},
+		"peer_id":                     {GAUGE, "", "Identifier of this pgbouncer process among its peers; 0 disables peering"},
+		"log_stats":                   {GAUGE, "", "Whether pgbouncer logs its aggregated statistics every stats_period"},
+	},
+	// SHOW LISTS returns a list and items column, one row per list
+	"lists": {
+		"databases":     {GAUGE, "", "Count of databases"},
+		"users":         {GAUGE, "", "Count of users"},
+		"pools":         {GAUGE, "", "Count of pools"},
+		"free_clients":  {GAUGE, "", "Count of free clients"},
+		"used_clients":  {GAUGE, "", "Count of used clients"},
+		"login_clients": {GAUGE, "", "Count of clients in login state"},
+		"free_servers":  {GAUGE, "", "Count of free servers"},
+		"used_servers":  {GAUGE, "", "Count of used servers"},
+	},
+	"state": {
+		"active":    {BOOLEAN, "", "Boolean indicating whether pgbouncer is running normally, neither paused nor suspended"},
+		"paused":    {BOOLEAN, "", "Boolean indicating whether a global pgbouncer PAUSE is currently active"},
+		"suspended": {BOOLEAN, "", "Boolean indicating whether a pgbouncer SUSPEND is currently active"},
+	},
+	"totals": {
+		"total_xact_count":              {GAUGE, "xact_count_total", "Total number of SQL transactions pooled by the whole instance"},
+		"total_query_count":             {GAUGE, "query_count_total", "Total number of SQL queries pooled by the whole instance"},
+		"total_received":                {GAUGE, "received_bytes_total", "Total volume in bytes of network traffic received by the whole instance"},
+		"total_sent":                    {GAUGE, "sent_bytes_total", "Total volume in bytes of network traffic sent by the whole instance"},
+		"total_xact_time":               {GAUGE_MS, "xact_time_seconds_total", "Total number of seconds spent by the whole instance when connected to PostgreSQL in a transaction"},
+		"total_query_time":              {GAUGE_MS, "query_time_seconds_total", "Total number of seconds spent by the whole instance when actively connected to PostgreSQL, executing queries"},
+		"total_wait_time":               {GAUGE_MS, "wait_time_seconds_total", "Total time spent by clients of the whole instance waiting for a server, in seconds"},
+		"total_client_parse_count":      {GAUGE, "client_parse_count_total", "Total number of prepared statements created by clients of the whole instance"},
+		"total_server_parse_count":      {GAUGE, "server_parse_count_total", "Total number of prepared statements created by the whole instance on servers"},
+		"total_bind_count":              {GAUGE, "bind_count_total", "Total number of prepared statements readied for execution by clients of the whole instance"},
+		"avg_client_parse_count":        {GAUGE, "avg_client_parse_count", "Average number of prepared statements created by clients per second in last stat period, for the whole instance"},
+		"avg_server_parse_count":        {GAUGE, "avg_server_parse_count", "Average number of prepared statements created on servers per second in last stat period, for the whole instance"},
+		"avg_bind_count":                {GAUGE, "avg_bind_count", "Average number of prepared statements readied for execution per second in last stat period, for the whole instance"},
+		"total_server_assignment_count": {GAUGE, "server_assignment_count_total", "Total number of times a server was assigned to a client, for the whole instance"},
+		"avg_server_assignment_count":   {GAUGE, "avg_server_assignment_count", "Average number of times a server was assigned to a client per second in last stat period, for the whole instance"},
+		"avg_xact_count":                {GAUGE, "avg_xact_count", "Average transactions per second in last stat period, for the whole instance"},
+		"avg_query_count":               {GAUGE, "avg_queries_per_second", "Average queries per second in last stat period, for the whole instance"},
+		"avg_recv":                      {GAUGE, "avg_data_recv_bytes_per_second", "Average received (from clients) bytes per second, for the whole instance"},
+		"avg_sent":                      {GAUGE, "avg_sent", "Average sent (to clients) bytes per second, for the whole instance"},
+		"avg_xact_time":                 {GAUGE_MS, "avg_xact_time_seconds", "Average transaction duration in seconds, for the whole instance"},
+		"avg_query_time":                {GAUGE_MS, "avg_query_time_seconds", "Average query duration in seconds, for the whole instance"},
+		"avg_wait_time":                 {GAUGE_MS, "avg_wait_time_seconds", "Time spent by clients waiting for a server in seconds (average per second), for the whole instance"},
+	},
+}
+
+// Versions of pgbouncer supporting each SHOW command, for the commands not supported by every version
+var namespaceVersions = map[string]versionRange{
+	"totals":         {min: pgbouncerVersion{1, 8, 0}},
+	"stats_totals":   {min: pgbouncerVersion{1, 8, 0}},
+	"stats_averages": {min: pgbouncerVersion{1, 8, 0}},
+	"state":          {min: pgbouncerVersion{1, 12, 0}},
+	"peers":          {min: pgbouncerVersion{1, 19, 0}},
+	"peer_pools":     {min: pgbouncerVersion{1, 19, 0}},
+}
+
+// Versions of pgbouncer returning each column, for the columns not returned by every version
+var columnVersions = map[string]map[string]versionRange{
+	"stats": {
+		"avg_req":                       {max: pgbouncerVersion{1, 8, 0}},
+		"avg_query":                     {max: pgbouncerVersion{1, 8, 0}},
+		"total_requests":                {max: pgbouncerVersion{1, 8, 0}},
+		"total_client_parse_count":      {min: pgbouncerVersion{1, 21, 0}},
+		"total_server_parse_count":      {min: pgbouncerVersion{1, 21, 0}},
+		"total_bind_count":              {min: pgbouncerVersion{1, 21, 0}},
+		"avg_client_parse_count":        {min: pgbouncerVersion{1, 21, 0}},
+		"avg_server_parse_count":        {min: pgbouncerVersion{1, 21, 0}},
+		"avg_bind_count":                {min: pgbouncerVersion{1, 21, 0}},
+		"total_server_assignment_count": {min: pgbouncerVersion{1, 23, 0}},
+		"avg_server_assignment_count":   {min: pgbouncerVersion{1, 23, 0}},
 	},
 }
 
+// Row converters replacing the default converter of their namespace
+var namespaceRowConverters = map[string]RowConverter{
+	"clients_wait": metricClientsWaitConverter,
+	"pools":        metricPoolsConverter,
+	"version":      metricVersionConverter,
+}
+
 var metricRowMaps = map[string]map[string]ColumnMapping{
 	"databases": {
 		"name":                {LABEL, "", ""},
@@ -135,20 +419,43 @@ var metricRowMaps = map[string]map[string]ColumnMapping{
 		"pool_size":           {GAUGE, "", "Maximum number of connection per pool for backend connections"},
 		"reserve_pool":        {GAUGE, "reserve_pool_size", "Number of extra connections by which the pool_size can be exceeded temporarily"},
 		"pool_mode":           {LABEL, "", "Nature of connection pooling"},
+		"min_pool_size":       {GAUGE, "", "Minimum number of server connections kept open for this database"},
+		"server_lifetime":     {GAUGE, "server_lifetime_seconds", "Maximum lifetime of a server connection for this database, overriding the global setting"},
+		"load_balance_hosts":  {LABEL, "", ""},
 		"max_connections":     {GAUGE, "", "Maximum number of client connections allowed"},
 		"current_connections": {GAUGE, "", "Current number of client connections"},
 		"paused":              {GAUGE, "", "Boolean indicating whether a pgbouncer PAUSE is currently active for this database"},
 		"disabled":            {GAUGE, "", "Boolean indicating whether a pgbouncer DISABLE is currently active for this database"},
 	},
-	"lists": {
-		"databases":     {GAUGE, "", "Count of databases"},
-		"users":         {GAUGE, "", "Count of users"},
-		"pools":         {GAUGE, "", "Count of pools"},
-		"free_clients":  {GAUGE, "", "Count of free clients"},
-		"used_clients":  {GAUGE, "", "Count of used clients"},
-		"login_clients": {GAUGE, "", "Count of clients in login state"},
-		"free_servers":  {GAUGE, "", "Count of free servers"},
-		"used_servers":  {GAUGE, "", "Count of used servers"},
+	"dns_hosts": {
+		"hostname": {LABEL, "", ""},
+		"ttl":      {GAUGE, "ttl_seconds", "How many seconds until the next DNS lookup of this host"},
+		"addrs":    {LIST, "addresses", "Number of addresses currently resolved for this host"},
+	},
+	"dns_zones": {
+		"zonename": {LABEL, "", ""},
+		"serial":   {GAUGE, "", "Current serial of the DNS zone as seen by pgbouncer"},
+		"count":    {GAUGE, "hosts", "Number of hostnames tracked by pgbouncer in this zone"},
+	},
+	"mem": {
+		"name":     {LABEL, "", ""},
+		"size":     {GAUGE, "size_bytes", "Size of a single object in this cache, shown as bytes"},
+		"used":     {GAUGE, "used_objects", "Number of objects of this cache currently in use"},
+		"free":     {GAUGE, "free_objects", "Number of objects of this cache allocated but currently free"},
+		"memtotal": {GAUGE, "memtotal_bytes", "Total memory allocated by this cache, shown as bytes"},
+	},
+	"peer_pools": {
+		"peer_id":               {LABEL, "", ""},
+		"cl_active_cancel_req":  {GAUGE, "", "Client connections that have forwarded query cancellations to this peer and are waiting for its answer"},
+		"cl_waiting_cancel_req": {GAUGE, "", "Client connections that have not forwarded query cancellations to this peer yet"},
+		"sv_active_cancel":      {GAUGE, "", "Server connections to this peer currently forwarding a cancel request"},
+		"sv_login":              {GAUGE, "", "Server connections to this peer currently in the process of logging in"},
+	},
+	"peers": {
+		"peer_id":   {LABEL, "", ""},
+		"host":      {LABEL, "", ""},
+		"port":      {LABEL, "", ""},
+		"pool_size": {GAUGE, "", "Maximum number of server connections that can be made to this peer"},
 	},
 	"pools": {
 		"database":   {LABEL, "", ""},
@@ -160,29 +467,121 @@ var metricRowMaps = map[string]map[string]ColumnMapping{
 		"sv_used":    {GAUGE, "", "Server connections idle more than server_check_delay, needing server_check_query, shown as connection"},
 		"sv_tested":  {GAUGE, "", "Server connections currently running either server_reset_query or server_check_query, shown as connection"},
 		"sv_login":   {GAUGE, "", "Server connections currently in the process of logging in, shown as connection"},
-		"maxwait":    {GAUGE, "maxwait_seconds", "Age of oldest unserved client connection, shown as second"},
+		"maxwait":    {GAUGE, "maxwait_seconds", "Age of oldest unserved client connection, shown as second with microsecond precision when pgbouncer reports maxwait_us"},
+		"maxwait_us": {DISCARD, "", ""}, // Folded into maxwait
 		"pool_mode":  {LABEL, "", ""},
 	},
 	"stats": {
-		"database":                  {LABEL, "", ""},
-		"avg_query_count":           {GAUGE, "avg_queries_per_second", "Average queries per second in last stat period"},
-		"avg_query":                 {GAUGE_MS, "avg_query_duration_microseconds", "The average query duration, shown as microsecond"},
-		"avg_query_time":            {GAUGE_MS, "avg_query_time_microseconds", "Average query time in microseconds"},
-		"avg_recv":                  {GAUGE, "avg_data_recv_bytes_per_second", "Average received (from clients) bytes per second"},
-		"avg_req":                   {GAUGE, "", "The average number of requests per second in last stat period, shown as request/second"},
-		"avg_sent":                  {GAUGE, "", "Average sent (to clients) bytes per second"},
-		"avg_wait_time":             {GAUGE_MS, "avg_wait_time_microseconds", "Time spent by clients waiting for a server in microseconds (average per second)"},
-		"avg_xact_count":            {GAUGE, "", "Average transactions per second in last stat period"},
-		"avg_xact_time":             {GAUGE_MS, "avg_xact_time_microseconds", "Average transaction duration in microseconds"},
-		"bytes_received_per_second": {GAUGE, "bytes_received_per_second_total", "The total network traffic received, shown as byte/second"},
-		"bytes_sent_per_second":     {GAUGE, "bytes_sent_per_second_total", "The total network traffic sent, shown as byte/second"},
-		"total_query_count":         {GAUGE, "query_count_total", "Total number of SQL queries pooled"},
-		"total_query_time":          {GAUGE_MS, "query_time_microseconds_total", "Total number of microseconds spent by pgbouncer when actively connected to PostgreSQL, executing queries"},
-		"total_received":            {GAUGE, "received_bytes_total", "Total volume in bytes of network traffic received by pgbouncer, shown as bytes"},
-		"total_requests":            {GAUGE, "requests_total", "Total number of SQL requests pooled by pgbouncer, shown as requests"},
-		"total_sent":                {GAUGE, "sent_bytes_total", "Total volume in bytes of network traffic sent by pgbouncer, shown as bytes"},
-		"total_wait_time":           {GAUGE_MS, "wait_time_microseconds_total", "Time spent by clients waiting for a server in microseconds"},
-		"total_xact_count":          {GAUGE, "xact_count_total", "Total number of SQL transactions pooled"},
-		"total_xact_time":           {GAUGE_MS, "xact_time_microseconds_total", "Total number of microseconds spent by pgbouncer when connected to PostgreSQL in a transaction, either idle in transaction or executing queries"},
+		"database":                      {LABEL, "", ""},
+		"avg_query_count":               {GAUGE, "avg_queries_per_second", "Average queries per second in last stat period"},
+		"avg_query":                     {GAUGE_MS, "avg_query_duration_microseconds", "The average query duration, shown as microsecond"},
+		"avg_query_time":                {GAUGE_MS, "avg_query_time_microseconds", "Average query time in microseconds"},
+		"avg_recv":                      {GAUGE, "avg_data_recv_bytes_per_second", "Average received (from clients) bytes per second"},
+		"avg_req":                       {GAUGE, "", "The average number of requests per second in last stat period, shown as request/second"},
+		"avg_sent":                      {GAUGE, "", "Average sent (to clients) bytes per second"},
+		"avg_wait_time":                 {GAUGE_MS, "avg_wait_time_microseconds", "Time spent by clients waiting for a server in microseconds (average per second)"},
+		"avg_xact_count":                {GAUGE, "", "Average transactions per second in last stat period"},
+		"avg_xact_time":                 {GAUGE_MS, "avg_xact_time_microseconds", "Average transaction duration in microseconds"},
+		"bytes_received_per_second":     {GAUGE, "bytes_received_per_second_total", "The total network traffic received, shown as byte/second"},
+		"bytes_sent_per_second":         {GAUGE, "bytes_sent_per_second_total", "The total network traffic sent, shown as byte/second"},
+		"total_query_count":             {GAUGE, "query_count_total", "Total number of SQL queries pooled"},
+		"total_query_time":              {GAUGE_MS, "query_time_microseconds_total", "Total number of microseconds spent by pgbouncer when actively connected to PostgreSQL, executing queries"},
+		"total_received":                {GAUGE, "received_bytes_total", "Total volume in bytes of network traffic received by pgbouncer, shown as bytes"},
+		"total_requests":                {GAUGE, "requests_total", "Total number of SQL requests pooled by pgbouncer, shown as requests"},
+		"total_sent":                    {GAUGE, "sent_bytes_total", "Total volume in bytes of network traffic sent by pgbouncer, shown as bytes"},
+		"total_wait_time":               {GAUGE_MS, "wait_time_microseconds_total", "Time spent by clients waiting for a server in microseconds"},
+		"total_xact_count":              {GAUGE, "xact_count_total", "Total number of SQL transactions pooled"},
+		"total_client_parse_count":      {GAUGE, "client_parse_count_total", "Total number of prepared statements created by clients"},
+		"total_server_parse_count":      {GAUGE, "server_parse_count_total", "Total number of prepared statements created by pgbouncer on a server"},
+		"total_bind_count":              {GAUGE, "bind_count_total", "Total number of prepared statements readied for execution by clients and forwarded to PostgreSQL"},
+		"avg_client_parse_count":        {GAUGE, "", "Average number of prepared statements created by clients per second in last stat period"},
+		"avg_server_parse_count":        {GAUGE, "", "Average number of prepared statements created by pgbouncer on a server per second in last stat period"},
+		"avg_bind_count":                {GAUGE, "", "Average number of prepared statements readied for execution by clients per second in last stat period"},
+		"total_server_assignment_count": {GAUGE, "server_assignment_count_total", "Total number of times a server was assigned to a client"},
+		"avg_server_assignment_count":   {GAUGE, "", "Average number of times a server was assigned to a client per second in last stat period"},
+		"total_xact_time":               {GAUGE_MS, "xact_time_microseconds_total", "Total number of microseconds spent by pgbouncer when connected to PostgreSQL in a transaction, either idle in transaction or executing queries"},
+	},
+	"stats_averages": {
+		"database":                {LABEL, "", ""},
+		"xact_count":              {GAUGE, "xact_count", "Average transactions per second in last stat period"},
+		"query_count":             {GAUGE, "query_count", "Average queries per second in last stat period"},
+		"bytes_received":          {GAUGE, "received_bytes", "Average received (from clients) bytes per second in last stat period"},
+		"bytes_sent":              {GAUGE, "sent_bytes", "Average sent (to clients) bytes per second in last stat period"},
+		"xact_time":               {GAUGE_MS, "xact_time_seconds", "Average transaction duration in seconds"},
+		"query_time":              {GAUGE_MS, "query_time_seconds", "Average query duration in seconds"},
+		"wait_time":               {GAUGE_MS, "wait_time_seconds", "Time spent by clients waiting for a server in seconds (average per second)"},
+		"client_parse_count":      {GAUGE, "client_parse_count", "Average number of prepared statements created by clients per second in last stat period"},
+		"server_parse_count":      {GAUGE, "server_parse_count", "Average number of prepared statements created by pgbouncer on a server per second in last stat period"},
+		"bind_count":              {GAUGE, "bind_count", "Average number of prepared statements readied for execution by clients per second in last stat period"},
+		"server_assignment_count": {GAUGE, "server_assignment_count", "Average number of times a server was assigned to a client per second in last stat period"},
+	},
+	"stats_totals": {
+		"database":                {LABEL, "", ""},
+		"xact_count":              {GAUGE, "xact_count_total", "Total number of SQL transactions pooled"},
+		"query_count":             {GAUGE, "query_count_total", "Total number of SQL queries pooled"},
+		"bytes_received":          {GAUGE, "received_bytes_total", "Total volume in bytes of network traffic received by pgbouncer"},
+		"bytes_sent":              {GAUGE, "sent_bytes_total", "Total volume in bytes of network traffic sent by pgbouncer"},
+		"xact_time":               {GAUGE_MS, "xact_time_seconds_total", "Total number of seconds spent by pgbouncer when connected to PostgreSQL in a transaction"},
+		"query_time":              {GAUGE_MS, "query_time_seconds_total", "Total number of seconds spent by pgbouncer when actively connected to PostgreSQL, executing queries"},
+		"wait_time":               {GAUGE_MS, "wait_time_seconds_total", "Total time spent by clients waiting for a server, in seconds"},
+		"client_parse_count":      {GAUGE, "client_parse_count_total", "Total number of prepared statements created by clients"},
+		"server_parse_count":      {GAUGE, "server_parse_count_total", "Total number of prepared statements created by pgbouncer on a server"},
+		"bind_count":              {GAUGE, "bind_count_total", "Total number of prepared statements readied for execution by clients and forwarded to PostgreSQL"},
+		"server_assignment_count": {GAUGE, "server_assignment_count_total", "Total number of times a server was assigned to a client"},
+	},
+}
+
+var metricAggregateMaps = map[string]map[string]AggregateMapping{
+	"clients": {
+		"database":    {LABEL, "", ""},
+		"user":        {LABEL, "", ""},
+		"state":       {LABEL, "", ""},
+		"connections": {COUNT, "", "Number of client connections, by database, user and state"},
+	},
+	"clients_by_application": {
+		"application_name": {LABEL, "", ""},
+		"connections":      {COUNT, "", "Number of client connections, by application_name"},
+	},
+	"clients_wait": {
+		"database": {LABEL, "", ""},
+		"user":     {LABEL, "", ""},
+		"seconds":  {HISTOGRAM, "wait", "Time waiting clients have been waiting for a server so far, sampled at each scrape"},
+	},
+	"fds": {
+		"task": {LABEL, "", ""},
+		"open": {COUNT, "", "Number of file descriptors in use by pgbouncer, by task (pooler, client or server)"},
+	},
+	"servers": {
+		"addr":        {LABEL, "", ""},
+		"port":        {LABEL, "", ""},
+		"state":       {LABEL, "", ""},
+		"connections": {COUNT, "", "Number of server connections, by backend address, port and state"},
+	},
+	"sockets": {
+		"type":                  {LABEL, "", ""},
+		"state":                 {LABEL, "", ""},
+		"count":                 {COUNT, "", "Number of sockets, by type and state"},
+		"recv_pos_bytes":        {SUM, "recv_pos", "Sum of the receive buffer positions of the sockets, shown as bytes"},
+		"recv_pos_max_bytes":    {MAX, "recv_pos", "Largest receive buffer position of the sockets, shown as bytes"},
+		"pkt_pos_bytes":         {SUM, "pkt_pos", "Sum of the parse positions in the receive buffers of the sockets, shown as bytes"},
+		"pkt_pos_max_bytes":     {MAX, "pkt_pos", "Largest parse position in the receive buffer of the sockets, shown as bytes"},
+		"pkt_remain_bytes":      {SUM, "pkt_remain", "Sum of the bytes remaining in the current packets of the sockets"},
+		"pkt_remain_max_bytes":  {MAX, "pkt_remain", "Largest number of bytes remaining in the current packet of the sockets"},
+		"send_pos_bytes":        {SUM, "send_pos", "Sum of the send buffer positions of the sockets, shown as bytes"},
+		"send_pos_max_bytes":    {MAX, "send_pos", "Largest send buffer position of the sockets, shown as bytes"},
+		"send_remain_bytes":     {SUM, "send_remain", "Sum of the bytes waiting to be sent by the sockets"},
+		"send_remain_max_bytes": {MAX, "send_remain", "Largest number of bytes waiting to be sent by the sockets"},
+	},
+	"version": {
+		"version": {LABEL, "", ""},
+		"info":    {COUNT, "", "Version of the pgbouncer instance. Always 1"},
+	},
+	// The number of configured users is already exported as lists_users.
+	"users": {
+		"name":                 {LABEL, "", ""},
+		"pool_mode":            {LABEL, "", ""},
+		"info":                 {COUNT, "", "Configured pgbouncer user, with its pool_mode override if any. Always 1"},
+		"max_user_connections": {SUM, "max_user_connections", "Maximum number of server connections allowed for this user"},
+		"current_connections":  {SUM, "current_connections", "Current number of server connections opened for this user"},
 	},
 }
@@ -0,0 +1,552 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// validateLabelName checks that a static label of targets is a valid label name, and does not clash with
+// the labels of the metrics themselves, the target label or the labels set by the discovery of the targets
+func validateLabelName(name string, targetLabel string) error {
+	if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if name == targetLabel {
+		return fmt.Errorf("label name %q is already used by the target label", name)
+	}
+	reserved := map[string]bool{"name": true, "value": true, "changeable": true, "le": true, "overflow": true,
+		"pgbouncer_host": true, "pgbouncer_peer_id": true}
+	for _, maps := range []map[string]map[string]ColumnMapping{metricRowMaps, metricKVMaps} {
+		for _, mappings := range maps {
+			for column, mapping := range mappings {
+				if mapping.usage == LABEL {
+					reserved[column] = true
+				}
+			}
+		}
+	}
+	for _, mappings := range metricAggregateMaps {
+		for column, mapping := range mappings {
+			if mapping.usage == LABEL {
+				reserved[column] = true
+			}
+		}
+	}
+	if reserved[name] {
+		return fmt.Errorf("label name %q is already used by pgbouncer metrics", name)
+	}
+	return nil
+}
+
+// Config is the content of the file given with --config.file
+type Config struct {
+	Targets []TargetConfig `yaml:"targets"`
+	// Rules rewriting the labels of the exported series, applied in order
+	RelabelRules []RelabelRule `yaml:"relabel_configs"`
+	// Values of the flags, nested by the dotted parts of their names, like web: {listen-address: ":9127"}
+	Options map[string]interface{} `yaml:",inline"`
+}
+
+// TargetConfig configures a pgbouncer scraped by the exporter
+type TargetConfig struct {
+	Name       string            `yaml:"name"`          // Value of the target label, defaults to the host and port of the DSN
+	DSN        string            `yaml:"dsn"`           // Connection string of the pgbouncer admin console
+	Fallbacks  []string          `yaml:"fallback_dsns"` // Other connection strings of the same pgbouncer, tried in order when dsn fails
+	Labels     map[string]string `yaml:"labels"`        // Labels added to every series of the target
+	Timeout    time.Duration     `yaml:"timeout"`       // Timeout of a scrape of the target, 0 for none
+	Collectors map[string]bool   `yaml:"collectors"`    // Namespaces enabled or disabled for the target, overriding the flags
+	Group      string            `yaml:"group"`         // Logical pgbouncer of the target, when several processes share its port
+}
+
+// loadConfig reads and validates a configuration file, whose target labels may not be named targetLabel
+func loadConfig(path string, targetLabel string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	names := make(map[string]bool)
+	for i, target := range config.Targets {
+		if target.DSN == "" {
+			return nil, fmt.Errorf("target %d of %s has no dsn", i, path)
+		}
+		config.Targets[i].DSN = normalizeConnectionString(target.DSN)
+		for j, fallback := range target.Fallbacks {
+			config.Targets[i].Fallbacks[j] = normalizeConnectionString(fallback)
+		}
+		if target.Name != "" && names[target.Name] {
+			return nil, fmt.Errorf("target name %q is used twice in %s", target.Name, path)
+		}
+		names[target.Name] = true
+		for name := range target.Labels {
+			if err := validateLabelName(name, targetLabel); err != nil {
+				return nil, fmt.Errorf("target %d in %s: %s", i, path, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+// flattenOptions returns the options of a configuration file by flag name, joining the nested keys with dots
+func flattenOptions(prefix string, options map[interface{}]interface{}, flat map[string]interface{}) error {
+	for key, value := range options {
+		name, ok := key.(string)
+		if !ok {
+			return fmt.Errorf("invalid option %v", key)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if nested, ok := value.(map[interface{}]interface{}); ok {
+			if err := flattenOptions(name, nested, flat); err != nil {
+				return err
+			}
+			continue
+		}
+		flat[name] = value
+	}
+	return nil
+}
+
+// A flag which can be repeated, like the lists of kingpin
+type cumulativeValue interface {
+	IsCumulative() bool
+}
+
+// applyOptions sets the flags of the application from the options of a configuration file,
+// unless they are given on the command line
+func applyOptions(app *kingpin.Application, given map[string]bool, options map[string]interface{}) error {
+	nested := make(map[interface{}]interface{}, len(options))
+	for key, value := range options {
+		nested[key] = value
+	}
+	flat := make(map[string]interface{})
+	if err := flattenOptions("", nested, flat); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(flat))
+	for name := range flat {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := app.GetFlag(name)
+		if f == nil || name == "config.file" || name == "version" || name == "help" {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+		var values []string
+		if list, ok := flat[name].([]interface{}); ok {
+			for _, value := range list {
+				values = append(values, fmt.Sprint(value))
+			}
+		} else {
+			values = []string{fmt.Sprint(flat[name])}
+		}
+		flagValue := f.Model().Value
+		if repeatable, ok := flagValue.(cumulativeValue); !ok || !repeatable.IsCumulative() {
+			// Lists of other flags are their comma separated values
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			if err := flagValue.Set(value); err != nil {
+				return fmt.Errorf("invalid value %q of option %q: %s", value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// socketConnectionString returns the connection string of the admin console of a pgbouncer
+// listening on a unix socket, authenticated by peer authentication unless the user is given with PGUSER
+func socketConnectionString(dir string, port int) string {
+	query := url.Values{}
+	query.Set("host", dir)
+	query.Set("port", strconv.Itoa(port))
+	query.Set("sslmode", "disable")
+	u := url.URL{Scheme: "postgres", Path: "/pgbouncer", RawQuery: query.Encode()}
+	return u.String()
+}
+
+// envOrFile returns the value of an environment variable, or the content of the file named by the variable suffixed by _FILE
+func envOrFile(key string) (string, error) {
+	if path, ok := os.LookupEnv(key + "_FILE"); ok {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s_FILE: %s", key, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return os.Getenv(key), nil
+}
+
+// envSecretFiles returns the files of DATA_SOURCE_URI, DATA_SOURCE_USER and DATA_SOURCE_PASS, when the connection strings come from them
+func envSecretFiles() []string {
+	if _, ok := os.LookupEnv("DATA_SOURCE_NAME"); ok {
+		return nil
+	}
+	var files []string
+	for _, key := range []string{"DATA_SOURCE_URI", "DATA_SOURCE_USER", "DATA_SOURCE_PASS"} {
+		if path := os.Getenv(key + "_FILE"); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// envConnectionStrings returns the connection strings made of DATA_SOURCE_URI, the comma separated hosts, ports, databases
+// and options of pgbouncer without the scheme, like localhost:6432/pgbouncer?sslmode=disable, with the user and password
+// of DATA_SOURCE_USER and DATA_SOURCE_PASS, like postgres_exporter. It returns nil when DATA_SOURCE_URI is not set.
+func envConnectionStrings() ([]string, error) {
+	uris, err := envOrFile("DATA_SOURCE_URI")
+	if err != nil || uris == "" {
+		return nil, err
+	}
+	user, err := envOrFile("DATA_SOURCE_USER")
+	if err != nil {
+		return nil, err
+	}
+	password, err := envOrFile("DATA_SOURCE_PASS")
+	if err != nil {
+		return nil, err
+	}
+
+	var connectionStrings []string
+	for _, uri := range splitConnectionStrings(uris) {
+		// The fallbacks of a pgbouncer are made the same way
+		var dsns []string
+		for _, address := range strings.Split(uri, "|") {
+			if i := strings.Index(address, "://"); i >= 0 {
+				address = address[i+3:]
+			}
+			u, err := url.Parse("postgres://" + address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DATA_SOURCE_URI %q: %s", address, err)
+			}
+			// Escaped by the URL, so that passwords need no encoding
+			switch {
+			case user != "" && password != "":
+				u.User = url.UserPassword(user, password)
+			case user != "":
+				u.User = url.User(user)
+			}
+			dsns = append(dsns, u.String())
+		}
+		connectionStrings = append(connectionStrings, strings.Join(dsns, "|"))
+	}
+	return connectionStrings, nil
+}
+
+// withoutEmptyPassword removes the empty password of a URL connection string, like user:@host,
+// which would keep the password from being looked up in .pgpass
+func withoutEmptyPassword(connectionString string) string {
+	u, err := url.Parse(connectionString)
+	if err != nil || u.Scheme == "" || u.User == nil {
+		return connectionString
+	}
+	if password, ok := u.User.Password(); !ok || password != "" {
+		return connectionString
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// checkPassFile warns about a .pgpass file ignored because it is readable by other users, as psql does
+func checkPassFile() {
+	if path := passFile(""); insecurePassFile(path) {
+		log.Warnf("password file %s has group or world access, and is ignored; permissions should be u=rw (0600) or less", path)
+	}
+}
+
+// passFile returns the password file of a connection string: its passfile, PGPASSFILE or ~/.pgpass
+func passFile(connectionString string) string {
+	if path, ok := connectionParameter(connectionString, "passfile"); ok {
+		return path
+	}
+	if path := os.Getenv("PGPASSFILE"); path != "" {
+		return path
+	}
+	// The home directory of the user, like pgx, rather than $HOME
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(current.HomeDir, ".pgpass")
+}
+
+// insecurePassFile tells whether a password file has group or world access, which libpq does not use
+func insecurePassFile(path string) bool {
+	if path == "" {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().Perm()&0077 != 0
+}
+
+// connectionParameter returns a parameter of a URL or keyword=value connection string, and whether it is set.
+// The password of a URL may also be in its user information.
+func connectionParameter(connectionString string, key string) (string, bool) {
+	if u, err := url.Parse(connectionString); err == nil && u.Scheme != "" {
+		if key == "password" && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				return password, true
+			}
+		}
+		values, ok := u.Query()[key]
+		if !ok {
+			return "", false
+		}
+		return values[0], true
+	}
+	params, err := parseKeywordValue(connectionString)
+	if err != nil {
+		return "", false
+	}
+	value, set := "", false
+	for _, param := range params {
+		if param[0] == key {
+			value, set = param[1], true
+		}
+	}
+	return value, set
+}
+
+// checkSSLFiles checks the sslmode and the certificate files of the connections to pgbouncer,
+// so that a mistake is reported at startup rather than at every scrape
+func checkSSLFiles(mode string, rootCert string, cert string, key string) error {
+	switch mode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("unsupported sslmode %q, should be disable, require, verify-ca or verify-full", mode)
+	}
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("a client certificate requires its key, and a key its certificate")
+	}
+	for _, path := range []string{rootCert, cert, key} {
+		if path == "" {
+			continue
+		}
+		if _, err := ioutil.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	if key != "" {
+		// Like libpq, refuse keys readable by other users
+		if info, err := os.Stat(key); err == nil && info.Mode().Perm()&0077 != 0 {
+			return fmt.Errorf("key file %s has group or world access; permissions should be u=rw (0600) or less", key)
+		}
+	}
+	return nil
+}
+
+// checkConnectionString checks the syntax of a connection string, resolving its connection service.
+// The errors do not quote the connection string, which may hold a password.
+func checkConnectionString(connectionString string) error {
+	_, err := parseConfig(connectionString)
+	return err
+}
+
+// withoutConnectionString returns the error of parsing a connection string without the connection string,
+// which may hold a password
+func withoutConnectionString(err error) error {
+	if wrapper, ok := err.(interface{ Unwrap() error }); ok {
+		if urlErr, ok := wrapper.Unwrap().(*url.Error); ok {
+			return urlErr.Err
+		}
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	// pgx quotes the connection string, with its password masked, before the reason
+	message := err.Error()
+	if i := strings.LastIndex(message, "`: "); strings.HasPrefix(message, "cannot parse `") && i >= 0 {
+		return errors.New(message[i+3:])
+	}
+	return err
+}
+
+// filesContent returns the content of the files, empty for those which cannot be read
+func filesContent(paths []string) string {
+	var content []string
+	for _, path := range paths {
+		b, _ := ioutil.ReadFile(path)
+		content = append(content, string(b))
+	}
+	return strings.Join(content, "\x00")
+}
+
+// splitConnectionStrings splits a comma or newline separated list of connection strings
+func splitConnectionStrings(list string) []string {
+	var connectionStrings []string
+	for _, connectionString := range splitUnquoted(list, ",\n") {
+		if connectionString = strings.TrimSpace(connectionString); connectionString != "" {
+			dsns := splitUnquoted(connectionString, "|")
+			for i, dsn := range dsns {
+				dsns[i] = normalizeConnectionString(strings.TrimSpace(dsn))
+			}
+			connectionStrings = append(connectionStrings, strings.Join(dsns, "|"))
+		}
+	}
+	return connectionStrings
+}
+
+// withConnectTimeout sets the connect_timeout of a connection string, in seconds, unless it has one
+func withConnectTimeout(connectionString string, timeout time.Duration) string {
+	if _, ok := connectionParameter(connectionString, "connect_timeout"); timeout <= 0 || ok {
+		return connectionString
+	}
+	seconds := strconv.Itoa(int(math.Ceil(timeout.Seconds())))
+	return withDefaultParameters(connectionString, [][2]string{{"connect_timeout", seconds}})
+}
+
+// withDefaultParameters sets the parameters of a URL or keyword=value connection string which it does not set itself
+func withDefaultParameters(connectionString string, params [][2]string) string {
+	if len(params) == 0 {
+		return connectionString
+	}
+	if u, err := url.Parse(connectionString); err == nil && u.Scheme != "" {
+		query := u.Query()
+		for _, param := range params {
+			if _, ok := query[param[0]]; !ok {
+				query.Set(param[0], param[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	own, err := parseKeywordValue(connectionString)
+	if err != nil {
+		// Left for the connector to report
+		return connectionString
+	}
+	set := make(map[string]bool, len(own))
+	for _, param := range own {
+		set[param[0]] = true
+	}
+	for _, param := range params {
+		if !set[param[0]] {
+			own = append(own, param)
+		}
+	}
+	return formatKeywordValue(own)
+}
+
+// splitUnquoted splits s around the separators outside of the quoted values of keyword=value connection strings
+func splitUnquoted(s string, separators string) []string {
+	var (
+		fields  []string
+		start   int
+		quoted  bool
+		escaped bool
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '\'':
+			quoted = !quoted
+		case !quoted && strings.ContainsRune(separators, r):
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, s[start:])
+}
+
+// normalizeConnectionString returns a URL connection string with its user and password URL encoded, so that
+// passwords with @, /, % or : can be written as is, like postgres://user:p@ss/w%rd@host:6432/pgbouncer.
+// The password is taken up to the last @ before the query. Valid URLs and keyword=value connection strings
+// are returned unchanged.
+func normalizeConnectionString(connectionString string) string {
+	i := strings.Index(connectionString, "://")
+	if i < 0 {
+		return connectionString
+	}
+	// A password with a / is otherwise parsed as the port, and the rest of it as the path
+	if u, err := url.Parse(connectionString); err == nil && !strings.Contains(u.Path, "@") {
+		return connectionString
+	}
+
+	scheme, rest := connectionString[:i], connectionString[i+3:]
+	query := ""
+	if q := strings.Index(rest, "?"); q >= 0 {
+		rest, query = rest[:q], rest[q:]
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return connectionString
+	}
+	userInfo, hostAndPath := rest[:at], rest[at+1:]
+	var user *url.Userinfo
+	if colon := strings.Index(userInfo, ":"); colon >= 0 {
+		user = url.UserPassword(unescapeUserInfo(userInfo[:colon]), unescapeUserInfo(userInfo[colon+1:]))
+	} else {
+		user = url.User(unescapeUserInfo(userInfo))
+	}
+	return scheme + "://" + user.String() + "@" + hostAndPath + query
+}
+
+// unescapeUserInfo decodes a user or password already URL encoded, and returns the others as is
+func unescapeUserInfo(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// key identifies the connection strings of a target
+func (c TargetConfig) key() string {
+	return strings.Join(append([]string{c.DSN}, c.Fallbacks...), "|")
+}
+
+// targetConfigs makes the target configurations of a list of connection strings.
+// A connection string may be followed by fallbacks to the same pgbouncer, separated by |.
+func targetConfigs(connectionStrings []string) []TargetConfig {
+	var targets []TargetConfig
+	for _, connectionString := range connectionStrings {
+		dsns := splitUnquoted(connectionString, "|")
+		targets = append(targets, TargetConfig{DSN: dsns[0], Fallbacks: dsns[1:]})
+	}
+	return targets
+}
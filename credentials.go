@@ -0,0 +1,156 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// credentials are the user and password of the pgbouncer admin console, an empty user keeping the one of the connection string
+type credentials struct {
+	user     string
+	password string
+}
+
+// A credentialSource fetches the credentials from a secret store. It returns when to fetch them again,
+// 0 for the default refresh interval.
+type credentialSource interface {
+	fetch(ctx context.Context) (credentials, time.Duration, error)
+}
+
+// credentialWatcher keeps the credentials of a source fresh
+type credentialWatcher struct {
+	name     string
+	source   credentialSource
+	interval time.Duration
+	onChange func()
+
+	mutex   sync.RWMutex
+	current credentials
+}
+
+// newCredentialWatcher fetches the credentials of a source, and fetches them again in the background
+// when they expire or every interval, calling onChange when they change
+func newCredentialWatcher(name string, source credentialSource, interval time.Duration, onChange func()) (*credentialWatcher, error) {
+	w := &credentialWatcher{name: name, source: source, interval: interval}
+	refresh, err := w.fetch()
+	if err != nil {
+		return nil, err
+	}
+	w.onChange = onChange
+	go w.run(refresh)
+	return w, nil
+}
+
+// fetch fetches the credentials, and returns when to fetch them again
+func (w *credentialWatcher) fetch() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c, refresh, err := w.source.fetch(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if refresh <= 0 || refresh > w.interval {
+		refresh = w.interval
+	}
+
+	w.mutex.Lock()
+	changed := c != w.current
+	w.current = c
+	w.mutex.Unlock()
+	if changed && w.onChange != nil {
+		log.Infof("Credentials changed in %s", w.name)
+		w.onChange()
+	}
+	return refresh, nil
+}
+
+// run fetches the credentials when they expire, retrying with a growing delay on errors
+func (w *credentialWatcher) run(refresh time.Duration) {
+	retry := 5 * time.Second
+	for {
+		time.Sleep(refresh)
+		next, err := w.fetch()
+		if err != nil {
+			log.Errorf("error fetching the credentials from %s, retrying in %s: %s", w.name, retry, err)
+			refresh = retry
+			if retry *= 2; retry > w.interval {
+				retry = w.interval
+			}
+			continue
+		}
+		refresh, retry = next, 5*time.Second
+	}
+}
+
+// get returns the current credentials
+func (w *credentialWatcher) get() (string, string) {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.current.user, w.current.password
+}
+
+// withCredentials returns the targets with the user and password in their connection strings
+func withCredentials(targets []TargetConfig, user string, password string) []TargetConfig {
+	result := make([]TargetConfig, 0, len(targets))
+	for _, config := range targets {
+		config.DSN = connectionStringWithCredentials(config.DSN, user, password)
+		fallbacks := make([]string, 0, len(config.Fallbacks))
+		for _, fallback := range config.Fallbacks {
+			fallbacks = append(fallbacks, connectionStringWithCredentials(fallback, user, password))
+		}
+		config.Fallbacks = fallbacks
+		result = append(result, config)
+	}
+	return result
+}
+
+// connectionStringWithCredentials sets the user and password of a URL or keyword=value connection string
+func connectionStringWithCredentials(connectionString string, user string, password string) string {
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		u, err := url.Parse(connectionString)
+		if err != nil {
+			return connectionString
+		}
+		if user == "" && u.User != nil {
+			user = u.User.Username()
+		}
+		u.User = url.UserPassword(user, password)
+		return u.String()
+	}
+
+	params, err := parseKeywordValue(connectionString)
+	if err != nil {
+		return connectionString
+	}
+	var result [][2]string
+	for _, param := range params {
+		if param[0] != "password" && (param[0] != "user" || user == "") {
+			result = append(result, param)
+		}
+	}
+	if user != "" {
+		result = append(result, [2]string{"user", user})
+	}
+	return formatKeywordValue(append(result, [2]string{"password", password}))
+}
@@ -0,0 +1,411 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// A group of targets of a file_sd file, sharing the same labels
+type fileSDGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// loadFileSD reads the targets of a file_sd file, in JSON or YAML. Targets are either
+// connection strings, or host:port pairs replacing the host of the base connection string.
+func loadFileSD(path string, base string, targetLabel string) ([]TargetConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so both are parsed the same way
+	var groups []fileSDGroup
+	if err := yaml.UnmarshalStrict(content, &groups); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	var targets []TargetConfig
+	for _, group := range groups {
+		for name := range group.Labels {
+			if err := validateLabelName(name, targetLabel); err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		for _, address := range group.Targets {
+			dsn, err := targetDSN(address, base)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q in %s: %s", address, path, err)
+			}
+			targets = append(targets, TargetConfig{DSN: dsn, Labels: group.Labels})
+		}
+	}
+	return targets, nil
+}
+
+// targetDSN returns the connection string of a file_sd target
+func targetDSN(address string, base string) (string, error) {
+	if strings.Contains(address, "://") || strings.Contains(address, "=") {
+		return normalizeConnectionString(address), nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("host:port targets need a URL connection string to start from")
+	}
+	u.Host = address
+	return u.String(), nil
+}
+
+// targetsFile reloads the targets of the exporter from files
+type targetsFile struct {
+	exporter *Exporter
+	paths    []string
+	load     func() ([]TargetConfig, error)
+
+	mutex   sync.Mutex
+	current []TargetConfig
+}
+
+// reload reads the targets again, and applies them when they changed
+func (f *targetsFile) reload() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	targets, err := f.load()
+	if err != nil {
+		log.Errorf("error reloading targets, keeping the current ones: %s", err)
+		return
+	}
+	if reflect.DeepEqual(targets, f.current) {
+		return
+	}
+	if err := f.exporter.SetTargets(targets); err != nil {
+		log.Errorf("error reloading targets, keeping the current ones: %s", err)
+		return
+	}
+	log.Infof("Reloaded %d targets from %s", len(targets), strings.Join(f.paths, ", "))
+	f.current = targets
+}
+
+// watch reloads the targets whenever one of the files changes
+func (f *targetsFile) watch() error {
+	return watchFiles(f.paths, f.reload)
+}
+
+// watchFiles calls onChange whenever one of the files changes
+func watchFiles(paths []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the directories, as the files are usually replaced rather than written to, like the secrets
+	// mounted by Kubernetes, swapped at once by replacing the ..data symlink of their directory
+	for _, path := range paths {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("error watching %s: %s", strings.Join(paths, ", "), err)
+			}
+		}
+	}()
+	return nil
+}
+
+// watchFileSD reloads the targets of the exporter whenever the file_sd file changes
+func watchFileSD(e *Exporter, path string, base string, current []TargetConfig) error {
+	f := &targetsFile{exporter: e, paths: []string{path}, current: current, load: func() ([]TargetConfig, error) {
+		return loadFileSD(path, base, e.targetLabel)
+	}}
+	return f.watch()
+}
+
+// loadConnectionStrings reads a comma separated list of connection strings from a file
+func loadConnectionStrings(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	connectionStrings := splitConnectionStrings(string(content))
+	if len(connectionStrings) == 0 {
+		return nil, fmt.Errorf("no connection string in %s", path)
+	}
+	return connectionStrings, nil
+}
+
+// lookupSRV returns the targets of a DNS SRV record, labeled with their host
+func lookupSRV(name string, base string) ([]TargetConfig, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetConfig
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		dsn, err := targetDSN(net.JoinHostPort(host, strconv.Itoa(int(record.Port))), base)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, TargetConfig{DSN: dsn, Labels: map[string]string{"pgbouncer_host": host}})
+	}
+	// Keep the targets in a stable order, whatever the order of the answer
+	sort.Slice(targets, func(i, j int) bool { return targets[i].DSN < targets[j].DSN })
+	return targets, nil
+}
+
+// lookupSockets returns a target for every pgbouncer unix socket matching the pattern, like the
+// processes sharing a port with so_reuseport, labeled with their peer_id. probeDSN adds the connection parameters
+// of the exporter to the connection string querying the peer_id.
+func lookupSockets(pattern string, base string, probeDSN func(string) string) ([]TargetConfig, error) {
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetConfig
+	for _, path := range paths {
+		dsn, err := socketDSN(path, base)
+		if err != nil {
+			return nil, err
+		}
+		peerID, err := queryPeerID(probeDSN(dsn))
+		if err != nil {
+			// The socket may be left over by a stopped pgbouncer
+			log.Errorf("error querying the peer_id of %s, skipping it: %s", path, err)
+			continue
+		}
+		targets = append(targets, TargetConfig{
+			DSN:    dsn,
+			Labels: map[string]string{"pgbouncer_peer_id": peerID},
+			// The processes sharing a port make a single logical pgbouncer
+			Group: "localhost:" + strings.TrimPrefix(filepath.Base(path), ".s.PGSQL."),
+		})
+	}
+	return targets, nil
+}
+
+// socketDSN returns the connection string of a pgbouncer unix socket, like /var/run/pgbouncer/.s.PGSQL.6432
+func socketDSN(path string, base string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("socket targets need a URL connection string to start from")
+	}
+	dir, file := filepath.Split(path)
+	port := strings.TrimPrefix(file, ".s.PGSQL.")
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("%s is not named like a pgbouncer socket, .s.PGSQL.<port>", path)
+	}
+	u.Host = ""
+	query := u.Query()
+	query.Set("host", filepath.Clean(dir))
+	query.Set("port", port)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// queryPeerID returns the peer_id setting of a pgbouncer
+func queryPeerID(dsn string) (string, error) {
+	db, err := getDB(dsn, nil)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	// A pgbouncer which does not answer must not hold the lookup of the other sockets
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SHOW CONFIG;")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.NullString, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return "", err
+		}
+		if values[0].String == "peer_id" {
+			return values[1].String, nil
+		}
+	}
+	// pgbouncer older than 1.19 has no peer_id
+	return "0", rows.Err()
+}
+
+// Bounds of the port discovery, so that a lookup takes at most maxPortRange / probeWorkers probe timeouts
+const (
+	maxPortRange = 256 // Ports of a range
+	probeWorkers = 16  // Ports probed at once
+)
+
+// parsePortRange parses a range of ports like 6432-6440, of up to maxPortRange ports
+func parsePortRange(s string) (int, int, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return 0, 0, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	if last-first >= maxPortRange {
+		return 0, 0, fmt.Errorf("invalid port range %q, of more than %d ports", s, maxPortRange)
+	}
+	return first, last, nil
+}
+
+// lookupPorts returns a target for every port of the range where a pgbouncer admin console answers,
+// on the host of the base connection string. probeDSN adds the connection parameters of the exporter to the
+// connection string of the probes.
+func lookupPorts(portRange string, base string, probeDSN func(string) string) ([]TargetConfig, error) {
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("port range targets need a URL connection string to start from")
+	}
+	host := u.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+
+	dsns := make([]string, 0, last-first+1)
+	for port := first; port <= last; port++ {
+		dsn, err := targetDSN(net.JoinHostPort(host, strconv.Itoa(port)), base)
+		if err != nil {
+			return nil, err
+		}
+		dsns = append(dsns, dsn)
+	}
+
+	// The ports are probed by probeWorkers at once, and the targets kept in the order of the ports
+	var (
+		answered  = make([]bool, len(dsns))
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, probeWorkers)
+	)
+	for i := range dsns {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			if err := probe(probeDSN(dsns[i])); err != nil {
+				// Not the connection string, which holds the password
+				log.Debugf("nothing answering as pgbouncer on %s: %s", net.JoinHostPort(host, strconv.Itoa(first+i)), err)
+				return
+			}
+			answered[i] = true
+		}(i)
+	}
+	wg.Wait()
+
+	var targets []TargetConfig
+	for i, dsn := range dsns {
+		if answered[i] {
+			targets = append(targets, TargetConfig{DSN: dsn})
+		}
+	}
+	return targets, nil
+}
+
+// probe returns the error of querying the pgbouncer admin console of a connection string, nil when it answers
+func probe(dsn string) error {
+	db, err := getDB(dsn, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SHOW VERSION;")
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// watchTargets looks the targets up every interval, and reloads the targets of the exporter when they change
+func watchTargets(e *Exporter, source string, interval time.Duration, current []TargetConfig, lookup func() ([]TargetConfig, error)) {
+	go func() {
+		for range time.Tick(interval) {
+			targets, err := lookup()
+			if err != nil {
+				log.Errorf("error looking up targets from %s, keeping the current ones: %s", source, err)
+				continue
+			}
+			if reflect.DeepEqual(targets, current) {
+				continue
+			}
+			if err := e.SetTargets(targets); err != nil {
+				log.Errorf("error applying the targets from %s, keeping the current ones: %s", source, err)
+				continue
+			}
+			log.Infof("Found %d targets from %s", len(targets), source)
+			current = targets
+		}
+	}()
+}
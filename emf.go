@@ -0,0 +1,175 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of metrics of a CloudWatch EMF document
+const emfMaxMetrics = 100
+
+// emfEmitter writes the metrics of a gatherer as CloudWatch embedded metric format (EMF) documents,
+// one JSON document per line, collected by the CloudWatch agent or the awslogs driver of ECS.
+// The series sharing the same labels make one document, with the labels as dimensions. Gauges are
+// written as is, counters as the increase since the previous interval, and summaries and histograms
+// as their sum and count.
+type emfEmitter struct {
+	gatherer  prometheus.Gatherer
+	writer    io.Writer
+	namespace string
+	counters  map[string]float64
+}
+
+// emfMetric is a metric of the CloudWatchMetrics directive of an EMF document
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit,omitempty"`
+}
+
+// emfDocument collects the metrics of a set of labels
+type emfDocument struct {
+	labels  []*dto.LabelPair
+	metrics []emfMetric
+	values  map[string]float64
+}
+
+// newEmfEmitter returns an emitter writing to writer, with the metrics in the CloudWatch namespace
+func newEmfEmitter(gatherer prometheus.Gatherer, writer io.Writer, namespace string) *emfEmitter {
+	return &emfEmitter{gatherer: gatherer, writer: writer, namespace: namespace, counters: make(map[string]float64)}
+}
+
+// run emits the metrics every interval
+func (e *emfEmitter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.emit(time.Now()); err != nil {
+			log.Errorf("error writing the metrics in CloudWatch EMF: %s", err)
+		}
+	}
+}
+
+// emit gathers the metrics and writes their documents
+func (e *emfEmitter) emit(now time.Time) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		// Gather returns the metrics it could collect with the error
+		log.Errorf("error gathering the metrics for CloudWatch EMF: %s", err)
+	}
+
+	var (
+		keys      []string
+		documents = make(map[string]*emfDocument)
+	)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			var key strings.Builder
+			for _, label := range metric.Label {
+				key.WriteString(label.GetName() + "=" + label.GetValue() + "\xff")
+			}
+			document, ok := documents[key.String()]
+			if !ok {
+				document = &emfDocument{labels: metric.Label, values: make(map[string]float64)}
+				documents[key.String()] = document
+				keys = append(keys, key.String())
+			}
+			e.add(document, family, metric, key.String())
+		}
+	}
+
+	sort.Strings(keys)
+	encoder := json.NewEncoder(e.writer)
+	for _, key := range keys {
+		document := documents[key]
+		for first := 0; first < len(document.metrics); first += emfMaxMetrics {
+			last := first + emfMaxMetrics
+			if last > len(document.metrics) {
+				last = len(document.metrics)
+			}
+			if err := encoder.Encode(e.encode(document, document.metrics[first:last], now)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add adds the values of a metric to the document of its labels
+func (e *emfEmitter) add(document *emfDocument, family *dto.MetricFamily, metric *dto.Metric, key string) {
+	name := family.GetName()
+	unit := ""
+	switch {
+	case strings.HasSuffix(name, "_seconds") || strings.HasSuffix(name, "_seconds_total"):
+		unit = "Seconds"
+	case strings.HasSuffix(name, "_bytes") || strings.HasSuffix(name, "_bytes_total"):
+		unit = "Bytes"
+	}
+	set := func(name string, unit string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		document.metrics = append(document.metrics, emfMetric{Name: name, Unit: unit})
+		document.values[name] = value
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		set(name, unit, metric.Gauge.GetValue())
+	case dto.MetricType_UNTYPED:
+		set(name, unit, metric.Untyped.GetValue())
+	case dto.MetricType_COUNTER:
+		if increase, ok := counterIncrease(e.counters, name+"\xff"+key, metric.Counter.GetValue()); ok {
+			set(name, unit, increase)
+		}
+	case dto.MetricType_SUMMARY:
+		set(name+"_sum", unit, metric.Summary.GetSampleSum())
+		set(name+"_count", "Count", float64(metric.Summary.GetSampleCount()))
+	case dto.MetricType_HISTOGRAM:
+		set(name+"_sum", unit, metric.Histogram.GetSampleSum())
+		set(name+"_count", "Count", float64(metric.Histogram.GetSampleCount()))
+	}
+}
+
+// encode returns the EMF document of some metrics of a document
+func (e *emfEmitter) encode(document *emfDocument, metrics []emfMetric, now time.Time) map[string]interface{} {
+	dimensions := []string{}
+	result := make(map[string]interface{}, len(document.labels)+len(metrics)+1)
+	for _, label := range document.labels {
+		dimensions = append(dimensions, label.GetName())
+		result[label.GetName()] = label.GetValue()
+	}
+	for _, metric := range metrics {
+		result[metric.Name] = document.values[metric.Name]
+	}
+	result["_aws"] = map[string]interface{}{
+		"Timestamp": now.UnixNano() / int64(time.Millisecond),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  e.namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    metrics,
+		}},
+	}
+	return result
+}
@@ -17,50 +17,135 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/common/log"
+	log "github.com/sirupsen/logrus"
 )
 
 // Describe implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	// We cannot know in advance what metrics the exporter will generate
-	// from Postgres. So we use the poor man's describe method: Run a collect
-	// and send the descriptors of all the collected metrics. The problem
-	// here is that we need to connect to the Postgres DB. If it is currently
-	// unavailable, the descriptors will be incomplete. Since this is a
-	// stand-alone exporter and not used as a library within other code
-	// implementing additional metrics, the worst that can happen is that we
-	// don't detect inconsistent metrics created by this exporter
-	// itself. Also, a change in the monitored Postgres instance may change the
-	// exported metrics during the runtime of the exporter.
-
-	metricCh := make(chan prometheus.Metric)
-	doneCh := make(chan struct{})
+	// The descriptors are those of the metric maps of the targets, built with them, so that pgbouncer is not
+	// queried when the exporter is registered. The metrics of the unknown columns of pgbouncer, which can only
+	// be known by querying it, are not described.
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
 
-	go func() {
-		for m := range metricCh {
-			ch <- m.Desc()
+	targets := append([]*target{}, e.targets...)
+	for _, g := range e.groups {
+		targets = append(targets, g.target)
+	}
+	for _, t := range targets {
+		ch <- t.upDesc
+		ch <- t.staleDesc
+		ch <- t.staleAgeDesc
+		if t.snapshotDesc != nil {
+			ch <- t.snapshotDesc
 		}
-		close(doneCh)
-	}()
+		for _, mapping := range t.metricMap {
+			for _, metricMapping := range mapping.columnMappings {
+				if metricMapping.desc != nil {
+					ch <- metricMapping.desc
+				}
+			}
+			if mapping.infoDesc != nil {
+				ch <- mapping.infoDesc
+			}
+			if mapping.defaultDesc != nil {
+				ch <- mapping.defaultDesc
+			}
+			if mapping.sumDesc != nil {
+				ch <- mapping.sumDesc
+			}
+		}
+	}
 
-	e.Collect(metricCh)
-	close(metricCh)
-	<-doneCh
+	ch <- e.duration.Desc()
+	ch <- e.totalScrapes.Desc()
+	ch <- e.error.Desc()
+	e.targetTimeouts.Describe(ch)
+	e.reconnectAttempts.Describe(ch)
+	e.reconnects.Describe(ch)
+	e.cardinalityLimited.Describe(ch)
+	e.parseErrors.Describe(ch)
+	e.namespaceErrors.Describe(ch)
+	e.queryRetries.Describe(ch)
+	e.watchdogKills.Describe(ch)
+	e.unmappedColumns.Describe(ch)
+	for _, desc := range e.dbStatsDescs {
+		ch <- desc
+	}
 }
 
 // Collect implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.scrape(ch)
+	e.scrapeOrCached(ch)
 	ch <- e.duration
-	ch <- e.up
 	ch <- e.totalScrapes
 	ch <- e.error
+	e.targetTimeouts.Collect(ch)
+	e.reconnectAttempts.Collect(ch)
+	e.reconnects.Collect(ch)
+	e.cardinalityLimited.Collect(ch)
+	e.parseErrors.Collect(ch)
+	e.namespaceErrors.Collect(ch)
+	e.queryRetries.Collect(ch)
+	e.watchdogKills.Collect(ch)
+	e.unmappedColumns.Collect(ch)
+	e.collectDBStats(ch)
+}
+
+// Statistics of the connection pools of the exporter to the targets, exported as pgbouncer_exporter_db_<name>
+var dbStatsMetrics = []struct {
+	name  string
+	help  string
+	vtype prometheus.ValueType
+	value func(sql.DBStats) float64
+}{
+	{"max_open_connections", "Maximum number of connections of the exporter to a PgBouncer target.", prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+	{"open_connections", "Number of connections of the exporter to a PgBouncer target, in use or idle.", prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+	{"in_use_connections", "Number of connections of the exporter to a PgBouncer target running a query.", prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.InUse) }},
+	{"idle_connections", "Number of idle connections of the exporter to a PgBouncer target.", prometheus.GaugeValue,
+		func(s sql.DBStats) float64 { return float64(s.Idle) }},
+	{"wait_count_total", "Total number of queries to a PgBouncer target which waited for a connection.", prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+	{"wait_duration_seconds_total", "Total time the queries to a PgBouncer target waited for a connection.", prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+	{"max_idle_closed_total", "Total number of connections to a PgBouncer target closed as the idle connections were at their maximum.", prometheus.CounterValue,
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+}
+
+// collectDBStats collects the statistics of the connection pools to the targets, summed over their endpoints
+func (e *Exporter) collectDBStats(ch chan<- prometheus.Metric) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	for _, t := range e.targets {
+		values := make([]float64, len(dbStatsMetrics))
+		for _, db := range append([]*sql.DB{t.db}, t.fallbacks...) {
+			stats := db.Stats()
+			for i, metric := range dbStatsMetrics {
+				values[i] += metric.value(stats)
+			}
+		}
+		for i, metric := range dbStatsMetrics {
+			ch <- prometheus.MustNewConstMetric(e.dbStatsDescs[i], metric.vtype, values[i], t.name)
+		}
+	}
 }
 
 func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
@@ -76,71 +161,604 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	e.error.Set(0)
 	e.totalScrapes.Inc()
 
-	rows, err := e.db.Query("SHOW STATS")
+	concurrency := e.scrapeConcurrency
+	if concurrency <= 0 {
+		concurrency = len(e.targets) + len(e.groups)
+	}
+	// Targets are scraped in parallel, so that a slow pgbouncer does not delay the others
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, concurrency)
+	)
+	for _, t := range e.targets {
+		if t.group != "" && e.peerAggregation == "sum" {
+			// Only the sum of its group is exported
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(t *target) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			up := 0.0
+			if e.scrapeOrServeStale(ch, t, func(ch chan<- prometheus.Metric) bool { return e.scrapeTarget(ch, t) }) {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(t.upDesc, prometheus.GaugeValue, up)
+		}(t)
+	}
+	for _, g := range e.groups {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(g *peerGroup) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			up := 0.0
+			if e.scrapeOrServeStale(ch, g.target, func(ch chan<- prometheus.Metric) bool { return e.scrapeGroup(ch, g) }) {
+				up = 1
+			}
+			ch <- prometheus.MustNewConstMetric(g.upDesc, prometheus.GaugeValue, up)
+		}(g)
+	}
+	wg.Wait()
+}
+
+// Close closes the connections to the targets
+func (e *Exporter) Close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, t := range e.targets {
+		t.close()
+	}
+	e.targets = nil
+	e.groups = nil
+}
+
+// Status returns the status of the last scrape of every target
+func (e *Exporter) Status() []TargetStatus {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	var status []TargetStatus
+	for _, t := range e.targets {
+		t.statusMutex.Lock()
+		s := t.status
+		t.statusMutex.Unlock()
+		s.Name = t.name
+		status = append(status, s)
+	}
+	return status
+}
+
+// Show runs a SHOW command on a target, the first one if name is empty, and returns its columns and rows
+func (e *Exporter) Show(ctx context.Context, name string, command string) ([]string, [][]interface{}, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	for _, t := range e.targets {
+		if name != "" && t.name != name {
+			continue
+		}
+		defer e.releaseConnections(t)
+		m := &MetricMapFromNamespace{namespace: command}
+		columnNames, rows, _, err := m.queryRows(ctx, t.db)
+		return columnNames, rows, err
+	}
+	return nil, nil, fmt.Errorf("unknown target %q", name)
+}
+
+// Ready checks that the exporter can reach at least one of its targets. The targets are checked at once,
+// within 5 seconds in all, and the first answering cancels the checks of the others.
+func (e *Exporter) Ready() error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if len(e.targets) == 0 {
+		// Like an empty discovery file, or a failed lookup
+		return errors.New("no pgbouncer target")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, len(e.targets))
+	for _, t := range e.targets {
+		go func(t *target) {
+			rows, err := t.db.QueryContext(ctx, "SHOW VERSION;")
+			if err == nil {
+				_ = rows.Close()
+			} else {
+				err = fmt.Errorf("pgbouncer %s: %s", t.name, err)
+			}
+			e.releaseConnections(t)
+			errs <- err
+		}(t)
+	}
+
+	var err error
+	ready := false
+	for range e.targets {
+		if targetErr := <-errs; targetErr == nil {
+			ready = true
+			cancel()
+		} else if err == nil {
+			err = targetErr
+		}
+	}
+	if ready {
+		return nil
+	}
+	return err
+}
+
+// Check returns the collectors enabled on every target. When connect is set, it also connects to the
+// targets, and runs the SHOW commands of the collectors supported by their version of pgbouncer.
+func (e *Exporter) Check(connect bool) []TargetCheck {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	var checks []TargetCheck
+	for _, t := range e.targets {
+		check := TargetCheck{Name: t.name}
+		metricMap, connected := t.metricMap, false
+		if connect {
+			ctx, cancel := e.queryContext(context.Background())
+			v, err := queryPgbouncerVersion(ctx, t.db)
+			cancel()
+			if err != nil {
+				check.Errors = append(check.Errors, fmt.Sprintf("cannot connect: %s", err))
+			} else {
+				connected = true
+				check.Version = v.String()
+				metricMap = supportedMetricMaps(t.metricMap, v)
+			}
+		}
+		for _, mapping := range metricMap {
+			check.Collectors = append(check.Collectors, mapping.namespace)
+			if !connected {
+				continue
+			}
+			ctx, cancel := e.queryContext(context.Background())
+			_, _, _, err := mapping.queryRows(ctx, t.db)
+			cancel()
+			if err != nil {
+				check.Errors = append(check.Errors, strings.TrimSpace(err.Error()))
+			}
+		}
+		e.releaseConnections(t)
+		sort.Strings(check.Collectors)
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// scrapeTarget scrapes a single pgbouncer, and returns whether it is up
+func (e *Exporter) scrapeTarget(ch chan<- prometheus.Metric, t *target) bool {
+	var scrapeErr error
+	defer func(begun time.Time) {
+		t.setStatus(begun, scrapeErr)
+	}(time.Now())
+	defer e.releaseConnections(t)
+
+	ctx := context.Background()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	// A target which failed is not connected to again before the end of its backoff
+	retryAt, failing := t.backoff()
+	if failing && time.Now().Before(retryAt) {
+		log.Debugf("Not reconnecting to pgbouncer %s before %s", t.name, retryAt.Format(time.RFC3339))
+		scrapeErr = fmt.Errorf("reconnecting after %s", retryAt.Format(time.RFC3339))
+		e.error.Set(1)
+		return false
+	}
+	if failing {
+		e.reconnectAttempts.WithLabelValues(t.name).Inc()
+	}
+
+	// Use the first endpoint answering
+	var (
+		db       *sql.DB
+		err      error
+		timedOut bool
+	)
+	for _, db = range append([]*sql.DB{t.db}, t.fallbacks...) {
+		queryCtx, cancel := e.queryContext(ctx)
+		var rows *sql.Rows
+		rows, err = db.QueryContext(queryCtx, "SHOW STATS")
+		if err == nil {
+			_ = rows.Close()
+		}
+		timedOut = queryCtx.Err() != nil || isTimeout(err)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if len(t.fallbacks) > 0 {
+			log.Warnf("error pinging an endpoint of pgbouncer %s, trying the next one: %q", t.name, err)
+		}
+	}
 	if err != nil {
-		log.Errorf("error pinging pgbouncer: %q", err)
+		if timedOut {
+			e.targetTimeouts.WithLabelValues(t.name).Inc()
+		}
+		log.Errorf("error pinging pgbouncer %s: %q", t.name, err)
+		scrapeErr = err
 		e.error.Set(1)
-		e.up.Set(0)
-		return
+		if e.reconnectBackoff > 0 {
+			t.connectFailed(e.reconnectBackoff, e.reconnectBackoffMax)
+		}
+		// pgbouncer may come back with another version
+		t.resetVersion()
+		if e.onTargetDown != nil {
+			go e.onTargetDown()
+		}
+		return false
+	}
+	if failing {
+		log.Infof("Reconnected to pgbouncer %s", t.name)
+		e.reconnects.WithLabelValues(t.name).Inc()
+		t.connected()
 	}
-	_ = rows.Close()
-	log.Debug("Backend is up, proceeding with scrape")
-	e.up.Set(1)
+	log.Debugln("Backend is up, proceeding with scrape of", t.name)
+
+	// The version is detected before taking the connection of a consistent snapshot, which may be the only one
+	// of the pool
+	versionCtx, cancel := e.queryContext(ctx)
+	metricMaps := t.supportedMetricMaps(versionCtx, db)
+	cancel()
+
+	// With a consistent snapshot, the namespaces are queried one after the other on a single connection
+	var (
+		q           queryer = db
+		concurrency         = e.queryConcurrency
+	)
+	if e.consistentSnapshot {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			log.Errorf("error connecting to pgbouncer %s: %q", t.name, err)
+			scrapeErr = err
+			e.error.Set(1)
+			return false
+		}
+		defer conn.Close()
+		q, concurrency = conn, 1
+		defer func(begun time.Time) {
+			ch <- prometheus.MustNewConstMetric(t.snapshotDesc, prometheus.GaugeValue, time.Since(begun).Seconds())
+		}(time.Now())
+	}
+
+	// The namespaces are queried over up to concurrency connections at once, and no more once one timed out
+	var (
+		wg        sync.WaitGroup
+		errMutex  sync.Mutex
+		aborted   bool
+		semaphore = make(chan struct{}, concurrency)
+		setErr    = func(err error, abort bool) (first bool) {
+			errMutex.Lock()
+			defer errMutex.Unlock()
+			scrapeErr = err
+			first = abort && !aborted
+			aborted = aborted || abort
+			return first
+		}
+		isAborted = func() bool {
+			errMutex.Lock()
+			defer errMutex.Unlock()
+			return aborted
+		}
+	)
+	for _, mapping := range metricMaps {
+		semaphore <- struct{}{}
+		if isAborted() {
+			<-semaphore
+			break
+		}
+		wg.Add(1)
+		go func(mapping *MetricMapFromNamespace) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			queryCtx, cancel := e.queryContext(ctx)
+			nonfatal, err := mapping.Query(queryCtx, ch, q)
+			timedOut := queryCtx.Err() != nil || isTimeout(err)
+			cancel()
+			if len(nonfatal) > 0 {
+				for _, suberr := range nonfatal {
+					log.Errorln(suberr.Error())
+				}
+			}
 
-	for _, mapping := range e.metricMap {
-		nonfatal, err := mapping.Query(ch, e.db)
-		if len(nonfatal) > 0 {
-			for _, suberr := range nonfatal {
-				log.Errorln(suberr.Error())
+			if err != nil && timedOut {
+				log.Errorf("scrape of pgbouncer %s timed out: %s", t.name, err)
+				e.namespaceErrors.WithLabelValues(mapping.namespace).Inc()
+				// The timeout of the scrape is only counted once, by the first query it stopped
+				if setErr(err, true) {
+					e.targetTimeouts.WithLabelValues(t.name).Inc()
+				}
+				e.error.Set(1)
+				return
 			}
+			if err != nil {
+				log.Errorf("error scraping %s of pgbouncer %s: %s", mapping.namespace, t.name, err)
+				e.namespaceErrors.WithLabelValues(mapping.namespace).Inc()
+				setErr(err, false)
+				e.error.Set(1)
+				return
+			}
+			e.countParseErrors(mapping.namespace, nonfatal)
+		}(mapping)
+	}
+	wg.Wait()
+	return !aborted
+}
+
+// countParseErrors counts the nonfatal errors of the scrape of a namespace, and flags the scrape as failed
+func (e *Exporter) countParseErrors(namespace string, nonfatal []error) {
+	if len(nonfatal) > 0 {
+		e.parseErrors.WithLabelValues(namespace).Add(float64(len(nonfatal)))
+		e.namespaceErrors.WithLabelValues(namespace).Inc()
+		e.error.Set(1)
+	}
+}
+
+// releaseConnections closes the connections to a target after its queries, with e.closeConnections
+func (e *Exporter) releaseConnections(t *target) {
+	if e.closeConnections {
+		t.closeIdle(e.queryConcurrency)
+	}
+}
+
+// scrapeOrServeStale scrapes a target, and returns whether it is up. With e.serveStale, the metrics of a successful
+// scrape are kept, and served instead of those of a failed scrape until they are older than e.serveStale.
+func (e *Exporter) scrapeOrServeStale(ch chan<- prometheus.Metric, t *target, scrape func(chan<- prometheus.Metric) bool) bool {
+	if e.serveStale <= 0 {
+		return scrape(ch)
+	}
+
+	var up bool
+	begun := time.Now()
+	metrics := collectedMetrics(func(ch chan<- prometheus.Metric) {
+		up = scrape(ch)
+	})
+
+	stale, age := 0.0, 0.0
+	if up {
+		t.setCache(metrics, begun)
+	} else if cached, scraped := t.cache(); cached != nil && time.Since(scraped) <= e.serveStale {
+		log.Debugf("Serving the metrics of pgbouncer %s scraped at %s", t.name, scraped.Format(time.RFC3339))
+		metrics = cached
+		stale, age = 1, time.Since(scraped).Seconds()
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(t.staleDesc, prometheus.GaugeValue, stale)
+	ch <- prometheus.MustNewConstMetric(t.staleAgeDesc, prometheus.GaugeValue, age)
+	return up
+}
+
+// collectedMetrics returns the metrics sent by collect
+func collectedMetrics(collect func(chan<- prometheus.Metric)) []prometheus.Metric {
+	var (
+		metrics  []prometheus.Metric
+		metricCh = make(chan prometheus.Metric)
+		doneCh   = make(chan struct{})
+	)
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
 		}
+		close(doneCh)
+	}()
+	collect(metricCh)
+	close(metricCh)
+	<-doneCh
+	return metrics
+}
 
-		if err != nil {
-			// this needs to be removed.
-			log.Fatal(err)
+// scrapeOrCached scrapes the targets, or serves the metrics of the last scrape when it began less than
+// e.minInterval ago. Concurrent scrapes wait for the one running, and serve its metrics.
+func (e *Exporter) scrapeOrCached(ch chan<- prometheus.Metric) {
+	if e.minInterval <= 0 {
+		for _, m := range e.sharedScrape() {
+			ch <- m
 		}
-		e.error.Add(float64(len(nonfatal)))
+		return
+	}
+
+	e.scrapeCacheMutex.Lock()
+	defer e.scrapeCacheMutex.Unlock()
+	if since := time.Since(e.scrapedAt); since < e.minInterval {
+		log.Debugf("Serving the metrics scraped %s ago", since.Round(time.Millisecond))
+	} else {
+		e.scrapedAt = time.Now()
+		e.scrapeCache = e.sharedScrape()
+	}
+	for _, m := range e.scrapeCache {
+		ch <- m
 	}
 }
 
+// sharedScrape scrapes the targets, and returns their metrics. The scrapes arriving while one is running,
+// like those of a pair of Prometheus servers, wait for it and share its metrics rather than querying again.
+func (e *Exporter) sharedScrape() []prometheus.Metric {
+	e.scrapeCallMutex.Lock()
+	if call := e.scrapeCall; call != nil {
+		e.scrapeCallMutex.Unlock()
+		log.Debug("Waiting for the scrape running")
+		<-call.done
+		return call.metrics
+	}
+	call := &scrapeCall{done: make(chan struct{})}
+	e.scrapeCall = call
+	e.scrapeCallMutex.Unlock()
+
+	call.metrics = collectedMetrics(e.scrape)
+
+	e.scrapeCallMutex.Lock()
+	e.scrapeCall = nil
+	e.scrapeCallMutex.Unlock()
+	close(call.done)
+	return call.metrics
+}
+
+// queryContext returns the context of a single query of a scrape, limited to the connect timeout
+func (e *Exporter) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if e.connectTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, e.connectTimeout)
+}
+
+// isTimeout tells whether an error is the timeout of a connection, like its connect_timeout
+func isTimeout(err error) bool {
+	if pgconn.Timeout(err) {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// isTransient tells whether a query failed for a reason which may not last, like a connection reset by pgbouncer
+// or its refusal of more connections, rather than a timeout or an invalid command
+func isTransient(err error) bool {
+	if isTimeout(err) {
+		return false
+	}
+	if pgconn.SafeToRetry(err) {
+		// Failed before the query was sent
+		return true
+	}
+	for err != nil {
+		switch err := err.(type) {
+		case *pgconn.PgError:
+			// Connection exceptions, too many connections, and the shutdown of pgbouncer
+			return strings.HasPrefix(err.Code, "08") || err.Code == "53300" || err.Code == "57P01"
+		case *net.OpError:
+			return !err.Timeout()
+		}
+		if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true
+		}
+		// The errors of connecting wrap the network errors
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		err = wrapper.Unwrap()
+	}
+	return false
+}
+
+// queryer runs the queries of a scrape, on the pool of connections to a target or on a single connection
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
 // the scrape fails, and a slice of errors if they were non-fatal.
-func (m *MetricMapFromNamespace) Query(ch chan<- prometheus.Metric, db *sql.DB) ([]error, error) {
-	query := fmt.Sprintf("SHOW %s;", m.namespace)
+func (m *MetricMapFromNamespace) Query(ctx context.Context, ch chan<- prometheus.Metric, db queryer) ([]error, error) {
+	columnNames, rows, nonfatalErrors, err := m.queryRows(ctx, db)
+	if err != nil {
+		return nonfatalErrors, err
+	}
+	n, err := m.convertRows(columnNames, rows, ch)
+	return append(nonfatalErrors, n...), err
+}
+
+// queryRows runs the SHOW command of the namespace, or its custom query, and returns its column names and rows
+func (m *MetricMapFromNamespace) queryRows(ctx context.Context, db queryer) ([]string, [][]interface{}, []error, error) {
+	command := m.namespace
+	if m.command != "" {
+		command = m.command
+	}
+	query := fmt.Sprintf("SHOW %s;", command)
+	if m.query != "" {
+		query = m.query
+	}
 
 	// Don't fail on a bad scrape of one metric
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query)
+	for retry := 0; err != nil && retry < m.retries && isTransient(err); retry++ {
+		log.Warnf("Running SHOW %s again after a transient error: %s", strings.ToUpper(m.namespace), err)
+		if m.retried != nil {
+			m.retried.Inc()
+		}
+		select {
+		case <-time.After(m.retryDelay):
+		case <-ctx.Done():
+		}
+		rows, err = db.QueryContext(ctx, query)
+	}
 	if err != nil {
-		return []error{}, errors.New(fmt.Sprintln("Error running query on database: ", m.namespace, err))
+		return nil, nil, []error{}, errors.New(fmt.Sprintln("Error running query on database: ", m.namespace, err))
 	}
 
 	defer rows.Close()
 
-	var result rowResult
-	result.ColumnNames, err = rows.Columns()
+	columnNames, err := rows.Columns()
 	if err != nil {
-		return []error{}, errors.New(fmt.Sprintln("Error retrieving column list for: ", m.namespace, err))
+		return nil, nil, []error{}, errors.New(fmt.Sprintln("Error retrieving column list for: ", m.namespace, err))
 	}
 
+	var (
+		data           [][]interface{}
+		nonfatalErrors []error
+	)
+	for rows.Next() {
+		columnData := make([]interface{}, len(columnNames))
+		var scanArgs = make([]interface{}, len(columnNames))
+		for i := range columnData {
+			scanArgs[i] = &(columnData[i])
+		}
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			return nil, nil, []error{}, errors.New(fmt.Sprintln("Error retrieving rows:", m.namespace, err))
+		}
+		data = append(data, columnData)
+	}
+	if err := rows.Err(); err != nil {
+		log.Errorf("Failed scanning all rows due to scan failure: error was; %s", err)
+		nonfatalErrors = append(nonfatalErrors, fmt.Errorf("failed to consume all rows due to: %s", err))
+	}
+	return columnNames, data, nonfatalErrors, nil
+}
+
+// convertRows emits the metrics of the rows of the namespace
+func (m *MetricMapFromNamespace) convertRows(columnNames []string, rows [][]interface{}, ch chan<- prometheus.Metric) ([]error, error) {
+	if m.excludedRows != nil {
+		rows = m.filterRows(columnNames, rows)
+	}
+	if m.mergeKeys != nil {
+		rows = mergePeerRows(m.namespace, columnNames, m.mergeKeys, rows)
+	}
+	if m.cardinalityLimit > 0 {
+		columnNames, rows = m.limitCardinality(columnNames, rows)
+	}
+
+	var result rowResult
+	result.ColumnNames = columnNames
+
 	// Make a lookup map for the column indices
 	result.ColumnIdx = make(map[string]int, len(result.ColumnNames))
 	for i, n := range result.ColumnNames {
 		result.ColumnIdx[n] = i
 	}
-
-	result.ColumnData = make([]interface{}, len(result.ColumnNames))
-	var scanArgs = make([]interface{}, len(result.ColumnNames))
-	for i := range result.ColumnData {
-		scanArgs[i] = &(result.ColumnData[i])
+	if m.unmappedColumns != nil {
+		m.countUnmappedColumns(result.ColumnIdx)
 	}
 
 	var nonfatalErrors []error
 
-	for rows.Next() {
-		err = rows.Scan(scanArgs...)
-		if err != nil {
-			return []error{}, errors.New(fmt.Sprintln("Error retrieving rows:", m.namespace, err))
-		}
-
+	for _, row := range rows {
+		result.ColumnData = row
 		n, e := m.rowFunc(m, &result, ch)
 		if n != nil {
 			nonfatalErrors = append(nonfatalErrors, n...)
@@ -149,9 +767,15 @@ func (m *MetricMapFromNamespace) Query(ch chan<- prometheus.Metric, db *sql.DB)
 			return nonfatalErrors, e
 		}
 	}
-	if err := rows.Err(); err != nil {
-		log.Errorf("Failed scanning all rows due to scan failure: error was; %s", err)
-		nonfatalErrors = append(nonfatalErrors, fmt.Errorf("failed to consume all rows due to: %s", err))
+
+	if m.doneFunc != nil {
+		n, e := m.doneFunc(m, &result, ch)
+		if n != nil {
+			nonfatalErrors = append(nonfatalErrors, n...)
+		}
+		if e != nil {
+			return nonfatalErrors, e
+		}
 	}
 	return nonfatalErrors, nil
 }
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gcpSecretSource reads the password from a secret version of GCP Secret Manager, like
+// projects/x/secrets/y/versions/latest, authenticated as the service account of the metadata server,
+// which is the workload identity of the pod on GKE.
+type gcpSecretSource struct {
+	client *http.Client
+	name   string
+
+	token        string
+	tokenExpires time.Time
+}
+
+func (g *gcpSecretSource) fetch(ctx context.Context) (credentials, time.Duration, error) {
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return credentials{}, 0, err
+	}
+	var secret struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := getJSON(ctx, g.client, "https://secretmanager.googleapis.com/v1/"+g.name+":access",
+		map[string]string{"Authorization": "Bearer " + token}, &secret); err != nil {
+		return credentials{}, 0, err
+	}
+	password, err := base64.StdEncoding.DecodeString(secret.Payload.Data)
+	if err != nil {
+		return credentials{}, 0, fmt.Errorf("invalid payload of secret %s: %s", g.name, err)
+	}
+	return credentials{password: strings.TrimRight(string(password), "\r\n")}, 0, nil
+}
+
+// accessToken returns an access token of the metadata server, cached until it is about to expire
+func (g *gcpSecretSource) accessToken(ctx context.Context) (string, error) {
+	if g.token != "" && time.Now().Before(g.tokenExpires) {
+		return g.token, nil
+	}
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := getJSON(ctx, g.client, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token",
+		map[string]string{"Metadata-Flavor": "Google"}, &token); err != nil {
+		return "", fmt.Errorf("cannot get an access token from the metadata server: %s", err)
+	}
+	g.token = token.AccessToken
+	g.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+// getJSON decodes the JSON response of a GET request, retried when the server throttles requests
+func getJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, response interface{}) error {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && attempt < 4 {
+			_ = resp.Body.Close()
+			delay := time.Duration(attempt) * time.Second
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				delay = time.Duration(seconds) * time.Second
+			}
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ctx.Done():
+				return fmt.Errorf("%s answered %s: %s", req.URL.Host, resp.Status, ctx.Err())
+			}
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+}
@@ -3,9 +3,14 @@ module github.com/openwengo/pgbouncer_exporter
 go 1.12
 
 require (
-	github.com/lib/pq v1.2.0
-	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
-	github.com/prometheus/client_golang v1.2.1
-	github.com/prometheus/common v0.7.0
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/jackc/pgconn v1.12.1
+	github.com/jackc/pgx/v4 v4.16.1
+	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
+	github.com/prometheus/common v0.37.0
+	github.com/sirupsen/logrus v1.6.0
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
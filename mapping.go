@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Names of the column usages in mapping files
+var columnUsageNames = map[string]columnUsage{
+	"LABEL":    LABEL,
+	"COUNTER":  COUNTER,
+	"GAUGE":    GAUGE,
+	"GAUGE_MS": GAUGE_MS,
+	"LIST":     LIST,
+	"BOOLEAN":  BOOLEAN,
+	"DISCARD":  DISCARD,
+}
+
+// A column mapping as written in mapping files
+type columnMappingFile struct {
+	Usage          string `yaml:"usage"`
+	PromMetricName string `yaml:"promMetricName"`
+	Description    string `yaml:"description"`
+}
+
+// UnmarshalYAML reads a column mapping of a mapping file, like {usage: GAUGE, promMetricName: x, description: y}
+func (m *ColumnMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mapping columnMappingFile
+	if err := unmarshal(&mapping); err != nil {
+		return err
+	}
+	usage, ok := columnUsageNames[strings.ToUpper(mapping.Usage)]
+	if !ok {
+		return fmt.Errorf("invalid usage %q, should be one of %s", mapping.Usage, strings.Join(sortedUsageNames(), ", "))
+	}
+	if mapping.PromMetricName != "" && !labelNameRE.MatchString(mapping.PromMetricName) {
+		return fmt.Errorf("invalid promMetricName %q", mapping.PromMetricName)
+	}
+	*m = ColumnMapping{usage: usage, promMetricName: mapping.PromMetricName, description: mapping.Description}
+	return nil
+}
+
+func sortedUsageNames() []string {
+	names := make([]string, 0, len(columnUsageNames))
+	for name := range columnUsageNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadMetricMappings reads a mapping file overriding the column mappings of the SHOW commands, by namespace and column,
+// like the maps of metricRowMaps and metricKVMaps. Columns missing from the built-in mappings are added, and DISCARD
+// drops a column.
+func loadMetricMappings(path string) (map[string]map[string]ColumnMapping, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings map[string]map[string]ColumnMapping
+	if err := yaml.UnmarshalStrict(content, &mappings); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for namespace, columns := range mappings {
+		if _, ok := metricRowMaps[namespace]; ok {
+			continue
+		}
+		if _, ok := metricKVMaps[namespace]; ok {
+			for column, mapping := range columns {
+				if mapping.usage == LABEL {
+					return nil, fmt.Errorf("%s: column %s of %s cannot be a label, as the keys of SHOW %s are rows", path, column, namespace, strings.ToUpper(namespace))
+				}
+			}
+			continue
+		}
+		if _, ok := metricAggregateMaps[namespace]; ok {
+			return nil, fmt.Errorf("%s: the rows of %s are aggregated, so its columns cannot be mapped", path, namespace)
+		}
+		return nil, fmt.Errorf("%s: unknown namespace %q", path, namespace)
+	}
+	return mappings, nil
+}
+
+// withMappingOverrides returns the column mappings of a namespace with the overrides of a mapping file
+func withMappingOverrides(mappings map[string]ColumnMapping, overrides map[string]ColumnMapping) map[string]ColumnMapping {
+	if len(overrides) == 0 {
+		return mappings
+	}
+	merged := make(map[string]ColumnMapping, len(mappings)+len(overrides))
+	for column, mapping := range mappings {
+		merged[column] = mapping
+	}
+	for column, mapping := range overrides {
+		merged[column] = mapping
+	}
+	return merged
+}
+
+// discardedColumns returns overrides discarding the given columns
+func discardedColumns(columns ...string) map[string]ColumnMapping {
+	overrides := make(map[string]ColumnMapping, len(columns))
+	for _, column := range columns {
+		overrides[column] = ColumnMapping{usage: DISCARD}
+	}
+	return overrides
+}
+
+// columnMappings returns the mappings of the columns of a custom query, by column
+func (q CustomQuery) columnMappings() map[string]ColumnMapping {
+	mappings := make(map[string]ColumnMapping)
+	for _, metric := range q.Metrics {
+		for column, mapping := range metric {
+			mappings[column] = mapping
+		}
+	}
+	return mappings
+}
+
+// loadCustomQueries reads a custom queries file, like the queries.yml of postgres_exporter, keyed by the namespace
+// of the queries, which prefixes the names of their metrics:
+//
+//	pgbouncer_pools_waiting:
+//	  query: "SHOW POOLS"
+//	  metrics:
+//	    - database: {usage: LABEL}
+//	    - cl_waiting: {usage: GAUGE, description: Waiting clients}
+func loadCustomQueries(path string) (map[string]CustomQuery, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var queries map[string]CustomQuery
+	if err := yaml.UnmarshalStrict(content, &queries); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	for namespace, query := range queries {
+		if !labelNameRE.MatchString(namespace) {
+			return nil, fmt.Errorf("%s: invalid name %q, which prefixes the names of its metrics", path, namespace)
+		}
+		_, row := metricRowMaps[namespace]
+		_, kv := metricKVMaps[namespace]
+		_, aggregate := metricAggregateMaps[namespace]
+		if row || kv || aggregate {
+			return nil, fmt.Errorf("%s: %s is a built-in namespace", path, namespace)
+		}
+		if strings.TrimSpace(query.Query) == "" {
+			return nil, fmt.Errorf("%s: %s has no query", path, namespace)
+		}
+		columns := make(map[string]bool)
+		metrics := 0
+		for _, metric := range query.Metrics {
+			for column, mapping := range metric {
+				if columns[column] {
+					return nil, fmt.Errorf("%s: column %s of %s is mapped twice", path, column, namespace)
+				}
+				columns[column] = true
+				if mapping.usage != LABEL && mapping.usage != DISCARD {
+					metrics++
+				}
+			}
+		}
+		if metrics == 0 {
+			return nil, fmt.Errorf("%s: %s maps no column to a metric", path, namespace)
+		}
+	}
+	return queries, nil
+}
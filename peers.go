@@ -0,0 +1,234 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Namespaces summed across the peers of a group, with the columns identifying their rows.
+// The rows of namespaces without key columns are all kept, as their converter aggregates them.
+// The other namespaces are scraped from the first peer up.
+var peerSumNamespaces = map[string][]string{
+	"stats":                  {"database"},
+	"stats_totals":           {"database"},
+	"stats_averages":         {"database"},
+	"pools":                  {"database", "user"},
+	"totals":                 {"name"},
+	"clients":                nil,
+	"clients_by_application": nil,
+	"clients_wait":           nil,
+	"servers":                nil,
+	"sockets":                nil,
+}
+
+// A logical pgbouncer served by several processes sharing its port with so_reuseport
+type peerGroup struct {
+	*target // Series of the sum of the peers
+	members []*target
+}
+
+// scrapeGroup scrapes the sum of the peers of a group, and returns whether any of them is up
+func (e *Exporter) scrapeGroup(ch chan<- prometheus.Metric, g *peerGroup) bool {
+	ctx := context.Background()
+	if g.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.timeout)
+		defer cancel()
+	}
+
+	var dbs []*sql.DB
+	for _, t := range g.members {
+		defer e.releaseConnections(t)
+		queryCtx, cancel := e.queryContext(ctx)
+		rows, err := t.db.QueryContext(queryCtx, "SHOW STATS")
+		if err == nil {
+			_ = rows.Close()
+		}
+		cancel()
+		if err != nil {
+			log.Errorf("error pinging pgbouncer %s of %s: %q", t.name, g.name, err)
+			continue
+		}
+		dbs = append(dbs, t.db)
+	}
+	if len(dbs) == 0 {
+		e.error.Set(1)
+		g.resetVersion()
+		return false
+	}
+
+	versionCtx, cancel := e.queryContext(ctx)
+	metricMaps := g.supportedMetricMaps(versionCtx, dbs[0])
+	cancel()
+	for _, mapping := range metricMaps {
+		keys, sum := peerSumNamespaces[mapping.namespace]
+		if !sum {
+			queryCtx, cancel := e.queryContext(ctx)
+			nonfatal, err := mapping.Query(queryCtx, ch, dbs[0])
+			cancel()
+			e.countParseErrors(mapping.namespace, nonfatal)
+			if err != nil {
+				log.Errorf("error scraping %s of %s: %s", mapping.namespace, g.name, err)
+				e.namespaceErrors.WithLabelValues(mapping.namespace).Inc()
+				e.error.Set(1)
+			}
+			continue
+		}
+
+		var (
+			columnNames []string
+			rows        [][]interface{}
+		)
+		for _, db := range dbs {
+			queryCtx, cancel := e.queryContext(ctx)
+			peerColumns, peerRows, nonfatal, err := mapping.queryRows(queryCtx, db)
+			cancel()
+			for _, suberr := range nonfatal {
+				log.Errorln(suberr.Error())
+			}
+			e.countParseErrors(mapping.namespace, nonfatal)
+			if err != nil {
+				log.Errorf("error scraping %s of a peer of %s: %s", mapping.namespace, g.name, err)
+				e.namespaceErrors.WithLabelValues(mapping.namespace).Inc()
+				e.error.Set(1)
+				continue
+			}
+			if columnNames == nil {
+				columnNames = peerColumns
+			} else if strings.Join(columnNames, ",") != strings.Join(peerColumns, ",") {
+				log.Errorf("skipping %s of a peer of %s, its columns differ from the other peers", mapping.namespace, g.name)
+				continue
+			}
+			rows = append(rows, peerRows...)
+		}
+		if keys != nil {
+			rows = mergePeerRows(mapping.namespace, columnNames, keys, rows)
+		}
+		nonfatal, err := mapping.convertRows(columnNames, rows, ch)
+		for _, suberr := range nonfatal {
+			log.Errorln(suberr.Error())
+		}
+		e.countParseErrors(mapping.namespace, nonfatal)
+		if err != nil {
+			log.Errorf("error converting %s of %s: %s", mapping.namespace, g.name, err)
+			e.namespaceErrors.WithLabelValues(mapping.namespace).Inc()
+			e.error.Set(1)
+		}
+	}
+	return true
+}
+
+// mergePeerRows merges the rows of the peers, or of a namespace summed by its mergeKeys, having the same key columns. Numeric columns are summed,
+// except the maximum wait time which is the maximum of the peers, and the average durations which are averaged.
+func mergePeerRows(namespace string, columnNames []string, keys []string, rows [][]interface{}) [][]interface{} {
+	columnIdx := make(map[string]int, len(columnNames))
+	for i, name := range columnNames {
+		columnIdx[name] = i
+	}
+	var keyIdx []int
+	isKey := make(map[int]bool)
+	for _, key := range keys {
+		if i, ok := columnIdx[key]; ok {
+			keyIdx = append(keyIdx, i)
+			isKey[i] = true
+		}
+	}
+
+	var (
+		merged [][]interface{}
+		counts []int
+		index  = make(map[string]int)
+	)
+	for _, row := range rows {
+		var keyValues []string
+		for _, i := range keyIdx {
+			keyValues = append(keyValues, dbToString(row[i]))
+		}
+		key := strings.Join(keyValues, "\xff")
+		j, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, append([]interface{}{}, row...))
+			counts = append(counts, 1)
+			continue
+		}
+		counts[j]++
+		mergeRow(columnNames, columnIdx, isKey, merged[j], row)
+	}
+
+	// Average the average durations, given by columns or by the rows of SHOW TOTALS named after them
+	nameIdx, named := columnIdx["name"]
+	named = named && namespace == "totals" && isKey[nameIdx]
+	for j, row := range merged {
+		averageRow := named && isAverageDuration(dbToString(row[nameIdx]))
+		for i, name := range columnNames {
+			if !isKey[i] && (averageRow || isAverageDuration(name)) {
+				if v, ok := dbToFloat64(row[i]); ok {
+					row[i] = v / float64(counts[j])
+				}
+			}
+		}
+	}
+	return merged
+}
+
+// mergeRow adds a row of a peer to the merged row
+func mergeRow(columnNames []string, columnIdx map[string]int, isKey map[int]bool, merged []interface{}, row []interface{}) {
+	for i, name := range columnNames {
+		if isKey[i] {
+			continue
+		}
+		switch name {
+		case "maxwait":
+			// maxwait and maxwait_us make a single duration
+			if waitSeconds(columnIdx, row) > waitSeconds(columnIdx, merged) {
+				merged[i] = row[i]
+				if us, ok := columnIdx["maxwait_us"]; ok {
+					merged[us] = row[us]
+				}
+			}
+		case "maxwait_us":
+		default:
+			a, aok := dbToFloat64(merged[i])
+			b, bok := dbToFloat64(row[i])
+			if aok && bok {
+				merged[i] = a + b
+			}
+		}
+	}
+}
+
+// waitSeconds returns the maxwait of a pools row, in seconds
+func waitSeconds(columnIdx map[string]int, row []interface{}) float64 {
+	seconds, _ := dbToFloat64(row[columnIdx["maxwait"]])
+	if us, ok := columnIdx["maxwait_us"]; ok {
+		microseconds, _ := dbToFloat64(row[us])
+		seconds += microseconds / 1e6
+	}
+	return seconds
+}
+
+// isAverageDuration tells whether a column is an average duration, which is averaged rather than summed across peers
+func isAverageDuration(name string) bool {
+	return strings.HasPrefix(name, "avg_") && (strings.HasSuffix(name, "_time") || name == "avg_query")
+}
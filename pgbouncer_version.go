@@ -0,0 +1,139 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of a pgbouncer instance, as major, minor and patch numbers
+type pgbouncerVersion [3]int
+
+// Versions of pgbouncer supporting a SHOW command or column. min is included and max excluded;
+// a zero value leaves that side of the range open.
+type versionRange struct {
+	min, max pgbouncerVersion
+}
+
+// parsePgbouncerVersion parses a version like "1.21.0" or "PgBouncer 1.21.0"
+func parsePgbouncerVersion(s string) (pgbouncerVersion, error) {
+	var v pgbouncerVersion
+	parts := strings.SplitN(parseVersionString(s), ".", 3)
+	for i, part := range parts {
+		// Drop suffixes like "1.22.0rc1"
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			return pgbouncerVersion{}, fmt.Errorf("invalid pgbouncer version %q", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v pgbouncerVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}
+
+func (v pgbouncerVersion) isZero() bool {
+	return v == pgbouncerVersion{}
+}
+
+// less reports whether v is older than o
+func (v pgbouncerVersion) less(o pgbouncerVersion) bool {
+	for i := range v {
+		if v[i] != o[i] {
+			return v[i] < o[i]
+		}
+	}
+	return false
+}
+
+// contains tells whether the range holds the version. The zero version stands for the versions older than 1.12,
+// which do not report it, and is only left out of the ranges starting at 1.12 or later.
+func (r versionRange) contains(v pgbouncerVersion) bool {
+	if v.isZero() {
+		return r.min.less(pgbouncerVersion{1, 12, 0})
+	}
+	if !r.min.isZero() && v.less(r.min) {
+		return false
+	}
+	if !r.max.isZero() && !v.less(r.max) {
+		return false
+	}
+	return true
+}
+
+// queryPgbouncerVersion runs SHOW VERSION. pgbouncer versions older than 1.12 only answer with a notice,
+// in which case the zero version is returned.
+func queryPgbouncerVersion(ctx context.Context, db *sql.DB) (pgbouncerVersion, error) {
+	rows, err := db.QueryContext(ctx, "SHOW VERSION;")
+	if err != nil {
+		return pgbouncerVersion{}, err
+	}
+	defer rows.Close()
+
+	var v pgbouncerVersion
+	if rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return pgbouncerVersion{}, err
+		}
+		if v, err = parsePgbouncerVersion(s); err != nil {
+			return pgbouncerVersion{}, err
+		}
+	}
+	return v, rows.Err()
+}
+
+// supportedMetricMaps returns the metric maps restricted to the SHOW commands and columns supported by the given
+// pgbouncer version. The zero version stands for versions older than 1.12, which don't report their version.
+func supportedMetricMaps(metricMaps []*MetricMapFromNamespace, v pgbouncerVersion) []*MetricMapFromNamespace {
+	var supported []*MetricMapFromNamespace
+	for _, mapping := range metricMaps {
+		if r, ok := namespaceVersions[mapping.namespace]; ok && !r.contains(v) {
+			log.Debugln("Namespace is not supported by pgbouncer", v, ":", mapping.namespace)
+			continue
+		}
+		columns, ok := columnVersions[mapping.namespace]
+		if !ok {
+			supported = append(supported, mapping)
+			continue
+		}
+
+		filtered := *mapping
+		filtered.columnMappings = make(map[string]MetricMap, len(mapping.columnMappings))
+		for name, metricMapping := range mapping.columnMappings {
+			if r, ok := columns[name]; ok && !r.contains(v) {
+				log.Debugln("Column is not supported by pgbouncer", v, ":", mapping.namespace, name)
+				continue
+			}
+			filtered.columnMappings[name] = metricMapping
+		}
+		supported = append(supported, &filtered)
+	}
+	return supported
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// RelabelRule rewrites a label of the exported series, like a subset of the relabel_configs of Prometheus.
+// The replace action sets target_label to the replacement when the regex matches the value of source_label,
+// like extracting shard="42" out of database="app_shard_42", and the rename action moves the value of
+// source_label to target_label.
+type RelabelRule struct {
+	Action      string `yaml:"action"`       // replace or rename, defaults to replace
+	SourceLabel string `yaml:"source_label"` // Label whose value is matched
+	Regex       string `yaml:"regex"`        // Regular expression matching the whole value, defaults to (.*)
+	TargetLabel string `yaml:"target_label"` // Label set by the rule
+	Replacement string `yaml:"replacement"`  // Value of target_label for replace, with the groups of regex like $1, defaults to $1
+
+	regex *regexp.Regexp
+}
+
+// UnmarshalYAML validates a rule, and compiles its regex
+func (r *RelabelRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	switch r.Action {
+	case "":
+		r.Action = "replace"
+	case "replace", "rename":
+	default:
+		return fmt.Errorf("unknown relabel action %q, expected replace or rename", r.Action)
+	}
+	if !labelNameRE.MatchString(r.SourceLabel) {
+		return fmt.Errorf("invalid source_label %q of a relabel rule", r.SourceLabel)
+	}
+	if !labelNameRE.MatchString(r.TargetLabel) || strings.HasPrefix(r.TargetLabel, "__") {
+		return fmt.Errorf("invalid target_label %q of a relabel rule", r.TargetLabel)
+	}
+	if r.Action == "rename" && r.Replacement != "" {
+		return fmt.Errorf("the rename of %s to %s keeps its value and takes no replacement", r.SourceLabel, r.TargetLabel)
+	}
+	if r.Regex == "" {
+		r.Regex = "(.*)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex of a relabel rule of %s: %s", r.SourceLabel, err)
+	}
+	r.regex = regex
+	return nil
+}
+
+// apply rewrites the labels of a series, by name. An empty value removes the label.
+func (r *RelabelRule) apply(labels map[string]string) {
+	value, ok := labels[r.SourceLabel]
+	if !ok {
+		return
+	}
+	match := r.regex.FindStringSubmatchIndex(value)
+	if match == nil {
+		return
+	}
+	switch r.Action {
+	case "replace":
+		labels[r.TargetLabel] = string(r.regex.ExpandString(nil, r.Replacement, value, match))
+	case "rename":
+		delete(labels, r.SourceLabel)
+		labels[r.TargetLabel] = value
+	}
+	if labels[r.TargetLabel] == "" {
+		delete(labels, r.TargetLabel)
+	}
+}
+
+// relabelGatherer applies relabel rules to the series of a gatherer, before they are served or emitted
+type relabelGatherer struct {
+	gatherer prometheus.Gatherer
+	mutex    sync.RWMutex
+	rules    []RelabelRule
+}
+
+// newRelabelGatherer returns a gatherer applying rules to the series of gatherer
+func newRelabelGatherer(gatherer prometheus.Gatherer, rules []RelabelRule) *relabelGatherer {
+	return &relabelGatherer{gatherer: gatherer, rules: rules}
+}
+
+// SetRules replaces the relabel rules, applied from the next gathering
+func (g *relabelGatherer) SetRules(rules []RelabelRule) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rules = rules
+}
+
+// Gather returns the relabeled metric families. The series made identical by the rules are only kept once.
+func (g *relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	g.mutex.RLock()
+	rules := g.rules
+	g.mutex.RUnlock()
+	if len(rules) == 0 {
+		return families, err
+	}
+
+	for _, family := range families {
+		seen := make(map[string]bool, len(family.Metric))
+		metrics := family.Metric[:0]
+		for _, metric := range family.Metric {
+			metric.Label = relabel(rules, metric.Label)
+			key := labelsKey(metric.Label)
+			if seen[key] {
+				log.Debugf("Dropping a series of %s made identical to another by the relabel rules: %s", family.GetName(), key)
+				continue
+			}
+			seen[key] = true
+			metrics = append(metrics, metric)
+		}
+		family.Metric = metrics
+	}
+	return families, err
+}
+
+// relabel applies the rules to the labels of a series, and returns them sorted by name
+func relabel(rules []RelabelRule, pairs []*dto.LabelPair) []*dto.LabelPair {
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	for i := range rules {
+		rules[i].apply(labels)
+	}
+
+	relabeled := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		name, value := name, value
+		relabeled = append(relabeled, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(relabeled, func(i, j int) bool {
+		return relabeled[i].GetName() < relabeled[j].GetName()
+	})
+	return relabeled
+}
+
+// labelsKey identifies a series of a metric family by its sorted labels
+func labelsKey(pairs []*dto.LabelPair) string {
+	parts := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		parts = append(parts, fmt.Sprintf("%s=%q", pair.GetName(), pair.GetValue()))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of the UDP packets sent to StatsD, fitting the usual MTU of 1500 bytes
+const statsdPacketSize = 1432
+
+var statsdInvalidRE = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// statsdEmitter sends the metrics of a gatherer to a StatsD server, for monitoring without Prometheus.
+// Gauges are sent as gauges, counters as the increase since the previous interval, and summaries and
+// histograms as the gauges of their sum and count. Label values are appended to the name, separated by dots.
+type statsdEmitter struct {
+	gatherer prometheus.Gatherer
+	conn     net.Conn
+	prefix   string
+	counters map[string]float64
+}
+
+// newStatsdEmitter returns an emitter sending to a StatsD server listening on UDP
+func newStatsdEmitter(gatherer prometheus.Gatherer, address string, prefix string) (*statsdEmitter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdEmitter{gatherer: gatherer, conn: conn, prefix: prefix, counters: make(map[string]float64)}, nil
+}
+
+// run emits the metrics every interval
+func (s *statsdEmitter) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.emit(); err != nil {
+			log.Errorf("error sending the metrics to StatsD: %s", err)
+		}
+	}
+}
+
+// emit gathers the metrics and sends them
+func (s *statsdEmitter) emit() error {
+	families, err := s.gatherer.Gather()
+	if err != nil {
+		// Gather returns the metrics it could collect with the error
+		log.Errorf("error gathering the metrics for StatsD: %s", err)
+	}
+
+	var packet bytes.Buffer
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			for _, line := range s.lines(family, metric) {
+				if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+					if _, err := s.conn.Write(packet.Bytes()); err != nil {
+						return err
+					}
+					packet.Reset()
+				}
+				if packet.Len() > 0 {
+					packet.WriteByte('\n')
+				}
+				packet.WriteString(line)
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lines returns the StatsD lines of a metric
+func (s *statsdEmitter) lines(family *dto.MetricFamily, metric *dto.Metric) []string {
+	name := s.prefix + family.GetName()
+	for _, label := range metric.Label {
+		value := label.GetValue()
+		if value == "" {
+			value = "none"
+		}
+		name += "." + statsdInvalidRE.ReplaceAllString(value, "_")
+	}
+
+	switch family.GetType() {
+	case dto.MetricType_GAUGE:
+		return gaugeLines(name, metric.Gauge.GetValue())
+	case dto.MetricType_UNTYPED:
+		return gaugeLines(name, metric.Untyped.GetValue())
+	case dto.MetricType_COUNTER:
+		increase, ok := counterIncrease(s.counters, name, metric.Counter.GetValue())
+		if !ok {
+			return nil
+		}
+		return []string{name + ":" + formatStatsd(increase) + "|c"}
+	case dto.MetricType_SUMMARY:
+		return append(gaugeLines(name+"_sum", metric.Summary.GetSampleSum()),
+			gaugeLines(name+"_count", float64(metric.Summary.GetSampleCount()))...)
+	case dto.MetricType_HISTOGRAM:
+		return append(gaugeLines(name+"_sum", metric.Histogram.GetSampleSum()),
+			gaugeLines(name+"_count", float64(metric.Histogram.GetSampleCount()))...)
+	}
+	return nil
+}
+
+// gaugeLines returns the StatsD line of a gauge. StatsD reads a leading sign as a change of the
+// gauge, so negative values are sent as a reset to 0 followed by the decrement.
+func gaugeLines(name string, value float64) []string {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	if value < 0 {
+		return []string{name + ":0|g", name + ":" + formatStatsd(value) + "|g"}
+	}
+	return []string{name + ":" + formatStatsd(value) + "|g"}
+}
+
+// counterIncrease returns the increase of a counter since its previous value, recorded in previous.
+// The increase is only known from the second value.
+func counterIncrease(previous map[string]float64, key string, value float64) (float64, bool) {
+	last, seen := previous[key]
+	previous[key] = value
+	if !seen {
+		return 0, false
+	}
+	if value < last {
+		// The counter was reset
+		last = 0
+	}
+	return value - last, true
+}
+
+// formatStatsd formats a value without exponent, which some StatsD servers do not parse
+func formatStatsd(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
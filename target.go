@@ -0,0 +1,197 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// supportedMetricMaps returns the metric maps supported by the pgbouncer version, detecting it on first use.
+// The mutex is not held during the detection, so that a pgbouncer which does not answer only holds the scrape
+// detecting its version, until ctx is done.
+func (t *target) supportedMetricMaps(ctx context.Context, db *sql.DB) []*MetricMapFromNamespace {
+	t.versionMutex.Lock()
+	version, supported := t.version, t.supportedMetricMap
+	t.versionMutex.Unlock()
+	if version != nil {
+		return supported
+	}
+
+	v, err := queryPgbouncerVersion(ctx, db)
+	if err != nil {
+		log.Errorf("error detecting pgbouncer version of %s, scraping all namespaces: %q", t.name, err)
+		return t.metricMap
+	}
+	supported = supportedMetricMaps(t.metricMap, v)
+
+	t.versionMutex.Lock()
+	defer t.versionMutex.Unlock()
+	if t.version != nil {
+		// Detected by a concurrent scrape
+		return t.supportedMetricMap
+	}
+	if v.isZero() {
+		log.Infof("pgbouncer %s did not report its version, assuming it is older than 1.12", t.name)
+	} else {
+		log.Infof("Detected pgbouncer version %s on %s", v, t.name)
+	}
+	t.version = &v
+	t.supportedMetricMap = supported
+	return supported
+}
+
+// setStatus records the result of a scrape of the target
+func (t *target) setStatus(begun time.Time, err error) {
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+	t.status = TargetStatus{
+		Name:       t.name,
+		Up:         err == nil,
+		LastScrape: begun,
+		Duration:   time.Since(begun),
+	}
+	if err != nil {
+		t.status.Error = err.Error()
+	}
+}
+
+// cache returns the metrics of the last successful scrape, and its time
+func (t *target) cache() ([]prometheus.Metric, time.Time) {
+	t.cacheMutex.Lock()
+	defer t.cacheMutex.Unlock()
+	return t.cached, t.cachedAt
+}
+
+// setCache records the metrics of a successful scrape
+func (t *target) setCache(metrics []prometheus.Metric, scraped time.Time) {
+	t.cacheMutex.Lock()
+	defer t.cacheMutex.Unlock()
+	t.cached = metrics
+	t.cachedAt = scraped
+}
+
+// backoff returns the time before which the target is not connected to again, and whether it failed
+func (t *target) backoff() (time.Time, bool) {
+	t.backoffMutex.Lock()
+	defer t.backoffMutex.Unlock()
+	return t.retryAt, t.failures > 0
+}
+
+// connectFailed records a failed connection, and delays the next one by initial doubled on every consecutive
+// failure, up to max. The delay is jittered between its half and itself, so that targets failing together
+// are not connected to again at once.
+func (t *target) connectFailed(initial, max time.Duration) {
+	t.backoffMutex.Lock()
+	defer t.backoffMutex.Unlock()
+	t.failures++
+	delay := initial
+	for i := 1; i < t.failures && delay < max; i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	t.retryAt = time.Now().Add(delay)
+	log.Infof("Reconnecting to pgbouncer %s in %s", t.name, delay.Round(time.Millisecond))
+}
+
+// connected records a successful connection, ending the backoff
+func (t *target) connected() {
+	t.backoffMutex.Lock()
+	defer t.backoffMutex.Unlock()
+	t.failures = 0
+	t.retryAt = time.Time{}
+}
+
+// close closes the connections to the target
+func (t *target) close() {
+	for _, db := range append([]*sql.DB{t.db}, t.fallbacks...) {
+		if err := db.Close(); err != nil {
+			log.Errorf("error closing connection to pgbouncer %s: %s", t.name, err)
+		}
+	}
+}
+
+// closeIdle closes the idle connections to the target, then lets up to idle connections be kept again
+func (t *target) closeIdle(idle int) {
+	for _, db := range append([]*sql.DB{t.db}, t.fallbacks...) {
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(idle)
+	}
+}
+
+func (t *target) resetVersion() {
+	t.versionMutex.Lock()
+	defer t.versionMutex.Unlock()
+	t.version = nil
+	t.supportedMetricMap = nil
+}
+
+// targetName names a target after the host and port of its connection string, never its credentials.
+// names holds the names already in use; a name in use gets the index of the target appended.
+func targetName(connectionString string, index int, names map[string]bool) string {
+	host, port := "", ""
+	if resolved, err := resolveService(connectionString); err == nil {
+		connectionString = resolved
+	}
+	if u, err := url.Parse(connectionString); err == nil && u.Scheme != "" {
+		host, port = u.Hostname(), u.Port()
+		// Unix sockets are given as parameters
+		if host == "" {
+			host = u.Query().Get("host")
+		}
+		if port == "" {
+			port = u.Query().Get("port")
+		}
+	} else {
+		for _, field := range strings.Fields(connectionString) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "host":
+				host = strings.Trim(kv[1], "'")
+			case "port":
+				port = strings.Trim(kv[1], "'")
+			}
+		}
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "5432"
+	}
+
+	name := fmt.Sprintf("%s:%s", host, port)
+	if names[name] {
+		name = fmt.Sprintf("%s#%d", name, index)
+	}
+	names[name] = true
+	return name
+}
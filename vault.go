@@ -0,0 +1,157 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Service account token of the pod, to log in to Vault with its Kubernetes auth method
+const kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultSource reads the credentials from a path of Vault, like a KV secret or the role of a database secrets engine.
+// Leased credentials are renewed until their lease cannot be extended, then read again.
+type vaultSource struct {
+	client         *http.Client
+	address        string
+	path           string
+	usernameKey    string
+	passwordKey    string
+	tokenFile      string // File of the Vault token, read at every login
+	token          string // Vault token, when there is no file nor role
+	kubernetesRole string // Role of the Kubernetes auth method, to log in with the service account token
+	kubernetesPath string // Mount path of the Kubernetes auth method
+
+	current  credentials
+	leaseID  string
+	renew    bool
+	duration time.Duration
+}
+
+// vaultResponse is the response of the Vault API to a read, a lease renewal or a login
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func (v *vaultSource) fetch(ctx context.Context) (credentials, time.Duration, error) {
+	token, err := v.login(ctx)
+	if err != nil {
+		return credentials{}, 0, err
+	}
+
+	if v.leaseID != "" && v.renew {
+		body, _ := json.Marshal(map[string]interface{}{"lease_id": v.leaseID, "increment": int(v.duration.Seconds())})
+		var renewed vaultResponse
+		err := v.request(ctx, http.MethodPut, "sys/leases/renew", token, body, &renewed)
+		// Past its maximum TTL, the lease is extended less than asked for, and the credentials are read again
+		if err == nil && time.Duration(renewed.LeaseDuration)*time.Second >= v.duration/2 {
+			return v.current, refreshAfter(time.Duration(renewed.LeaseDuration) * time.Second), nil
+		}
+	}
+
+	var secret vaultResponse
+	if err := v.request(ctx, http.MethodGet, v.path, token, nil, &secret); err != nil {
+		return credentials{}, 0, err
+	}
+	data := secret.Data
+	// KV version 2 nests the secret in data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	password, ok := data[v.passwordKey].(string)
+	if !ok {
+		return credentials{}, 0, fmt.Errorf("no %q in Vault secret %s", v.passwordKey, v.path)
+	}
+	user, _ := data[v.usernameKey].(string)
+
+	v.current = credentials{user: user, password: password}
+	v.leaseID, v.renew = secret.LeaseID, secret.Renewable
+	v.duration = time.Duration(secret.LeaseDuration) * time.Second
+	return v.current, refreshAfter(v.duration), nil
+}
+
+// login returns the Vault token, logging in with the Kubernetes auth method when a role is given
+func (v *vaultSource) login(ctx context.Context) (string, error) {
+	switch {
+	case v.kubernetesRole != "":
+		jwt, err := ioutil.ReadFile(kubernetesTokenFile)
+		if err != nil {
+			return "", err
+		}
+		body, _ := json.Marshal(map[string]string{"role": v.kubernetesRole, "jwt": strings.TrimSpace(string(jwt))})
+		var login vaultResponse
+		if err := v.request(ctx, http.MethodPost, "auth/"+v.kubernetesPath+"/login", "", body, &login); err != nil {
+			return "", err
+		}
+		if login.Auth == nil {
+			return "", fmt.Errorf("no token in the Vault login response")
+		}
+		return login.Auth.ClientToken, nil
+	case v.tokenFile != "":
+		// Read at every use, to follow a token renewed by an agent
+		token, err := ioutil.ReadFile(v.tokenFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	return v.token, nil
+}
+
+// request calls the Vault API, and decodes its response
+func (v *vaultSource) request(ctx context.Context, method string, path string, token string, body []byte, response *vaultResponse) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil && resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("invalid response of Vault to %s: %s", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Vault answered %s to %s: %s", resp.Status, path, strings.Join(response.Errors, ", "))
+	}
+	return nil
+}
+
+// refreshAfter returns when to refresh credentials leased for a duration, 0 for the default interval
+func refreshAfter(lease time.Duration) time.Duration {
+	return lease * 2 / 3
+}
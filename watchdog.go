@@ -0,0 +1,127 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// watchdogDialer dials the connections to a pgbouncer, and closes those whose query is not answered within
+// the deadline, like on a suspended pgbouncer, even when the query has no timeout
+type watchdogDialer struct {
+	deadline time.Duration
+
+	mutex  sync.Mutex
+	target string             // Name of the target, in the logs
+	kills  prometheus.Counter // Counts the connections closed, if set
+}
+
+// dialFunc returns the dial function of pgx dialing the connections with dial, and watching them
+func (d *watchdogDialer) dialFunc(dial pgconn.DialFunc) pgconn.DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &watchdogConn{Conn: conn, dialer: d}, nil
+	}
+}
+
+// setTarget names the target of the connections, and sets the counter of the connections closed
+func (d *watchdogDialer) setTarget(name string, kills prometheus.Counter) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.target = name
+	d.kills = kills
+}
+
+// killed logs and counts a connection closed by the watchdog
+func (d *watchdogDialer) killed(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	log.Errorf("pgbouncer %s did not answer within %s, closing its connection: %s", d.target, d.deadline, err)
+	if d.kills != nil {
+		d.kills.Inc()
+	}
+}
+
+// A connection to pgbouncer whose answers must arrive within the deadline of the watchdog after its queries
+type watchdogConn struct {
+	net.Conn
+	dialer *watchdogDialer
+
+	mutex       sync.Mutex
+	deadline    time.Time // Of the answer to the last query
+	pgxDeadline time.Time // Set by pgx, like to interrupt a query whose context is done, zero for none
+}
+
+// Write sends a query, and sets the deadline of its answer, unless pgx set an earlier one
+func (c *watchdogConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	c.deadline = time.Now().Add(c.dialer.deadline)
+	deadline := c.deadline
+	if !c.pgxDeadline.IsZero() && c.pgxDeadline.Before(deadline) {
+		deadline = c.pgxDeadline
+	}
+	err := c.Conn.SetReadDeadline(deadline)
+	c.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// SetDeadline keeps the deadline set by pgx, for the next queries
+func (c *watchdogConn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pgxDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline keeps the deadline set by pgx, for the next queries
+func (c *watchdogConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pgxDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read closes the connection when the answer did not arrive before the deadline, so that the query fails
+// and the connection is opened again by the next one. The earlier deadlines set by pgx to interrupt the
+// queries timing out are left to it.
+func (c *watchdogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !time.Now().Before(deadline) {
+		c.dialer.killed(err)
+		_ = c.Conn.Close()
+		// Not a timeout, after which pgx would keep the connection
+		return n, fmt.Errorf("no answer within %s", c.dialer.deadline)
+	}
+	return n, err
+}
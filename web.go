@@ -0,0 +1,307 @@
+/*
+Copyright 2019 The KubeDB Authors.
+Copyright (c) 2017 Kristoffer K Larsen <kristoffer@larsen.so>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://opensource.org/licenses/MIT
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authorized checks the bearer token of a request, in constant time
+func authorized(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// authHandler requires from every request either the basic authentication user and the password
+// of the bcrypt hash, or the bearer token, for those configured, except on the exempt paths
+type authHandler struct {
+	handler      http.Handler
+	user         string
+	passwordHash []byte
+	token        string
+	exempt       map[string]bool // Paths of the handlers checking a token of their own, like the lifecycle endpoints
+
+	// bcrypt is slow on purpose, so the passwords already checked are remembered by their hash
+	checked sync.Map
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.exempt[r.URL.Path] {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	if a.token != "" && authorized(r, a.token) {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if a.user != "" && ok && subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1 && a.checkPassword(password) {
+		a.handler.ServeHTTP(w, r)
+		return
+	}
+	if a.user != "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pgbouncer_exporter"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+func (a *authHandler) checkPassword(password string) bool {
+	sum := sha256.Sum256([]byte(password))
+	if _, ok := a.checked.Load(sum); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(a.passwordHash, []byte(password)) != nil {
+		return false
+	}
+	a.checked.Store(sum, true)
+	return true
+}
+
+// cidrFilter rejects the requests from addresses outside of its networks
+type cidrFilter struct {
+	handler  http.Handler
+	networks []*net.IPNet
+}
+
+// parseCIDRs parses a comma separated list of networks, like 10.0.0.0/8,::1/128
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (f *cidrFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range f.networks {
+			if network.Contains(ip) {
+				f.handler.ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+	log.Debugln("Rejected request from", r.RemoteAddr)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// readyHandler answers 200 when ready, checking readiness at most once per ttl
+func readyHandler(ready func() error, ttl time.Duration) http.HandlerFunc {
+	var (
+		mutex     sync.Mutex
+		checkedAt time.Time
+		err       error
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		if time.Since(checkedAt) > ttl {
+			err = ready()
+			checkedAt = time.Now()
+		}
+		lastErr := err
+		mutex.Unlock()
+
+		if lastErr != nil {
+			http.Error(w, fmt.Sprintf("Not ready: %s", lastErr), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("OK"))
+	}
+}
+
+// quitHandler asks the exporter to shut down gracefully on POST, like /-/quit of Prometheus
+func quitHandler(token string, quit chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		select {
+		case quit <- struct{}{}:
+		default:
+			// Already shutting down
+		}
+		_, _ = w.Write([]byte("Requesting termination... Goodbye!"))
+	}
+}
+
+// Read-only SHOW commands of the pgbouncer admin console, without SHOW FDS which blocks pgbouncer and returns
+// the password hashes and cancel keys of the connections
+var debugCommands = map[string]bool{
+	"active_sockets": true, "clients": true, "config": true, "databases": true, "dns_hosts": true,
+	"dns_zones": true, "lists": true, "mem": true, "peer_pools": true, "peers": true,
+	"pools": true, "servers": true, "sockets": true, "state": true, "stats": true, "stats_averages": true,
+	"stats_totals": true, "totals": true, "users": true, "version": true,
+}
+
+// debugHandler returns the rows of a SHOW command as JSON, like /debug/pgbouncer?command=pools&target=name
+func debugHandler(e *Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		command := strings.ToLower(r.URL.Query().Get("command"))
+		if !debugCommands[command] {
+			http.Error(w, fmt.Sprintf("unknown command %q", command), http.StatusBadRequest)
+			return
+		}
+		columnNames, rows, err := e.Show(r.Context(), r.URL.Query().Get("target"), command)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		result := make([]map[string]interface{}, 0, len(rows))
+		for _, row := range rows {
+			values := make(map[string]interface{}, len(columnNames))
+			for i, name := range columnNames {
+				if b, ok := row[i].([]byte); ok {
+					values[name] = string(b)
+				} else {
+					values[name] = row[i]
+				}
+			}
+			result = append(result, values)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Infoln("Write err : ", err)
+		}
+	}
+}
+
+// reloadHandler reloads the configuration of the exporter on POST, like /-/reload of Prometheus
+func reloadHandler(token string, reload func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := reload(); err != nil {
+			log.Errorln(err)
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// loadCertPool reads the PEM certificates of a file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no PEM certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// certReloader serves a TLS certificate, loaded again whenever its files change
+type certReloader struct {
+	certFile, keyFile string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the files of cert
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if r.cert != nil {
+				log.Errorf("error checking TLS certificate file, keeping the current certificate: %s", err)
+				return r.cert, nil
+			}
+			return nil, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// The files may be half written
+			log.Errorf("error loading TLS certificate, keeping the current one: %s", err)
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil {
+		log.Infoln("Reloaded TLS certificate", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}